@@ -0,0 +1,160 @@
+/*
+Copyright © 2020 Brian Williams
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/Brian-Williams/nginx_flywheel/pkg"
+	"github.com/Brian-Williams/nginx_flywheel/pkg/consulp"
+	"github.com/Brian-Williams/nginx_flywheel/pkg/envp"
+	"github.com/Brian-Williams/nginx_flywheel/pkg/etcdp"
+	"github.com/Brian-Williams/nginx_flywheel/pkg/filep"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// providerConfig configures one provider of the chain; only the fields of its Type are used
+type providerConfig struct {
+	// Type is one of etcd, consul, file or env
+	Type   string `mapstructure:"type"`
+	LStrip string `mapstructure:"lstrip"`
+	// Endpoints of etcd
+	Endpoints []string `mapstructure:"endpoints"`
+	// Address and Token of consul
+	Address string `mapstructure:"address"`
+	Token   string `mapstructure:"token"`
+	// Prefix of consul keys or env variables
+	Prefix string `mapstructure:"prefix"`
+	// Overrides is the document of a file provider
+	Overrides string `mapstructure:"overrides"`
+}
+
+var (
+	// chainCmd represents the chain command
+	chainCmd = &cobra.Command{
+		Use:   "chain",
+		Short: "Rewrite an NGINX file using several variable providers in order of precedence",
+		Long: `Rewrite an NGINX file using several variable providers in order of precedence
+
+Providers are configured in the config file, highest precedence first:
+
+  chain:
+    policy: first
+    providers:
+      - type: env
+      - type: file
+        overrides: /etc/nginx_flywheel/overrides.yaml
+      - type: etcd
+        endpoints: [http://etcd-region:2379]
+      - type: etcd
+        endpoints: [http://etcd-global:2379]
+
+The first policy uses the first provider with a value, append combines the values of every provider.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := signalContext()
+			defer cancel()
+
+			if err := checkRenderFlags(); err != nil {
+				return err
+			}
+
+			source, err := parseSource()
+			if err != nil {
+				return err
+			}
+
+			log.Print("Replacing directive keys from chain")
+			overrider, err := newChainProvider()
+			if err != nil {
+				return err
+			}
+			defer overrider.Close()
+
+			return render(ctx, source, overrider)
+		},
+	}
+)
+
+// newChainProvider creates the chain from the providers of the config file
+func newChainProvider() (flywheel.OverrideProvider, error) {
+	var configs []providerConfig
+	if err := viper.UnmarshalKey("chain.providers", &configs); err != nil {
+		msg := "invalid chain providers config"
+		log.Err(err).Msg(msg)
+		return nil, fmt.Errorf(msg+": %w", err)
+	}
+	if len(configs) == 0 {
+		msg := "no chain providers configured"
+		log.Error().Str("config", viper.ConfigFileUsed()).Msg(msg)
+		return nil, fmt.Errorf(msg)
+	}
+
+	chain := &flywheel.Chain{Policy: flywheel.MergePolicy(viper.GetString("chain.policy"))}
+	for i, c := range configs {
+		p, err := newProvider(c)
+		if err != nil {
+			chain.Close()
+			msg := "failed to create chain provider"
+			log.Err(err).Int("provider", i).Str("type", c.Type).Msg(msg)
+			return nil, fmt.Errorf(msg+": %w", err)
+		}
+		chain.Providers = append(chain.Providers, p)
+	}
+	return chain, nil
+}
+
+// newProvider creates a provider from its config
+func newProvider(c providerConfig) (flywheel.OverrideProvider, error) {
+	if c.LStrip == "" {
+		c.LStrip = "/etc"
+	}
+	switch c.Type {
+	case "etcd":
+		client, err := clientv3.New(clientv3.Config{Endpoints: c.Endpoints})
+		if err != nil {
+			return nil, err
+		}
+		return &etcdp.Etcd3Provider{Client: client, LStrip: c.LStrip}, nil
+	case "consul":
+		if c.Address == "" {
+			c.Address = "http://127.0.0.1:8500"
+		}
+		return &consulp.ConsulProvider{Address: c.Address, Token: c.Token, Prefix: c.Prefix, LStrip: c.LStrip}, nil
+	case "file":
+		overrides, err := filep.ReadFile(c.Overrides)
+		if err != nil {
+			return nil, err
+		}
+		return &filep.FileProvider{Overrides: overrides, LStrip: c.LStrip}, nil
+	case "env":
+		return &envp.EnvProvider{Prefix: c.Prefix, LStrip: c.LStrip}, nil
+	default:
+		return nil, fmt.Errorf("unknown provider type: %q", c.Type)
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(chainCmd)
+	chainCmd.AddCommand(newKeysCmd(newChainProvider))
+	addRenderFlags(chainCmd.Flags())
+	// chain flags
+	chainCmd.PersistentFlags().String("policy", string(flywheel.MergeFirst), "how to combine provider values: first or append")
+	viper.BindPFlag("chain.policy", chainCmd.PersistentFlags().Lookup("policy"))
+}
@@ -0,0 +1,79 @@
+/*
+Copyright © 2020 Brian Williams
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"github.com/Brian-Williams/nginx_flywheel/pkg"
+	"github.com/Brian-Williams/nginx_flywheel/pkg/consulp"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var (
+	consulAddress string
+	consulToken   string
+	consulPrefix  string
+
+	// consulCmd represents the consul command
+	consulCmd = &cobra.Command{
+		Use:   "consul",
+		Short: "Rewrite an NGINX file using Consul KV keys as a variable provider",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := signalContext()
+			defer cancel()
+
+			if err := checkRenderFlags(); err != nil {
+				return err
+			}
+
+			source, err := parseSource()
+			if err != nil {
+				return err
+			}
+
+			log.Print("Replacing directive keys from consul")
+			overrider, err := newConsulProvider()
+			if err != nil {
+				return err
+			}
+			defer overrider.Close()
+
+			return render(ctx, source, overrider)
+		},
+	}
+)
+
+// newConsulProvider creates the provider from the consul flags
+func newConsulProvider() (flywheel.OverrideProvider, error) {
+	return &consulp.ConsulProvider{
+		Address: consulAddress,
+		Token:   consulToken,
+		Prefix:  consulPrefix,
+		LStrip:  lstrip,
+	}, nil
+}
+
+func init() {
+	rootCmd.AddCommand(consulCmd)
+	consulCmd.AddCommand(newKeysCmd(newConsulProvider))
+	addRenderFlags(consulCmd.Flags())
+	// consul flags
+	consulCmd.PersistentFlags().StringVar(&consulAddress, "address", "http://127.0.0.1:8500", "consul agent address")
+	consulCmd.PersistentFlags().StringVar(&consulToken, "token", "", "consul ACL token")
+	consulCmd.PersistentFlags().StringVar(&consulPrefix, "prefix", "", "consul KV path to nest keys under")
+	consulCmd.PersistentFlags().StringVar(&lstrip, "lstrip", "/etc", "prefix to strip from absolute path to produce consul key")
+}
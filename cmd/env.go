@@ -0,0 +1,76 @@
+/*
+Copyright © 2020 Brian Williams
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"github.com/Brian-Williams/nginx_flywheel/pkg"
+	"github.com/Brian-Williams/nginx_flywheel/pkg/envp"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var (
+	envPrefix string
+
+	// envCmd represents the env command
+	envCmd = &cobra.Command{
+		Use:   "env",
+		Short: "Rewrite an NGINX file using environment variables as a variable provider",
+		Long: `Rewrite an NGINX file using environment variables as a variable provider
+
+Keys are mapped to variable names by appending each segment of the key to the prefix with a double
+underscore, e.g. /nginx/worker_processes is read from NGINX_FLYWHEEL__NGINX__WORKER_PROCESSES. Lower case
+letters are upper cased, digits are kept and so is an underscore followed by a lower case letter. Any other byte,
+including an upper case letter, is escaped as _xx_ lower case hex, so a dot becomes _2e_.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := signalContext()
+			defer cancel()
+
+			if err := checkRenderFlags(); err != nil {
+				return err
+			}
+
+			source, err := parseSource()
+			if err != nil {
+				return err
+			}
+
+			log.Print("Replacing directive keys from environment")
+			overrider, err := newEnvProvider()
+			if err != nil {
+				return err
+			}
+			defer overrider.Close()
+
+			return render(ctx, source, overrider)
+		},
+	}
+)
+
+// newEnvProvider creates the provider from the env flags
+func newEnvProvider() (flywheel.OverrideProvider, error) {
+	return &envp.EnvProvider{Prefix: envPrefix, LStrip: lstrip}, nil
+}
+
+func init() {
+	rootCmd.AddCommand(envCmd)
+	envCmd.AddCommand(newKeysCmd(newEnvProvider))
+	addRenderFlags(envCmd.Flags())
+	// env flags
+	envCmd.PersistentFlags().StringVar(&envPrefix, "prefix", envp.DefaultPrefix, "prefix of the environment variable names")
+	envCmd.PersistentFlags().StringVar(&lstrip, "lstrip", "/etc", "prefix to strip from absolute path to produce override key")
+}
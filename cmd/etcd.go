@@ -18,10 +18,12 @@ package cmd
 import (
 	"context"
 	"fmt"
+	"reflect"
+	"time"
 
+	"github.com/Brian-Williams/nginx_flywheel/pkg"
 	"github.com/Brian-Williams/nginx_flywheel/pkg/etcdp"
 
-	"github.com/Brian-Williams/nginx_flywheel/pkg"
 	"github.com/aluttik/go-crossplane"
 	"github.com/coreos/etcd/clientv3"
 	"github.com/rs/zerolog/log"
@@ -31,54 +33,165 @@ import (
 var (
 	endpoints []string
 	lstrip    string
+	watch     bool
+	debounce  time.Duration
+	maxWait   time.Duration
+	revision  int64
 
 	// etcdCmd represents the etcd command
 	etcdCmd = &cobra.Command{
 		Use:   "etcd",
 		Short: "Rewrite an NGINX file using etcd keys as a variable provider",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			log.Debug().
-				Str("path", sourcePath).
-				Msg("Parsing file")
-			payload, err := crossplane.Parse(sourcePath, &crossplane.ParseOptions{ParseComments: true})
-			if err != nil {
-				msg := "failed to parse source file"
-				log.Err(err).Str("file", sourcePath).Msg(msg)
-				return fmt.Errorf(msg+": %w", err)
-			}
+			ctx, cancel := signalContext()
+			defer cancel()
 
-			log.Print("Replacing directive keys from etcd")
-			client, err := clientv3.New(clientv3.Config{Endpoints: endpoints})
-			if err != nil {
-				msg := "invalid NGINX configuration"
-				log.Err(err).Strs("endpoints", endpoints).Msg(msg)
+			if watch && revision != 0 {
+				msg := "--revision can't be used with --watch"
+				log.Error().Msg(msg)
 				return fmt.Errorf(msg)
 			}
-			overrider := &etcdp.Etcd3Provider{Client: client, LStrip: lstrip}
 
-			err = flywheel.OverridePayload(context.Background(), payload, overrider)
+			if err := checkRenderFlags(); err != nil {
+				return err
+			}
+
+			source, err := parseSource()
 			if err != nil {
-				msg := "overriding NGINX JSON failed"
-				log.Err(err).Msg(msg)
-				return fmt.Errorf(msg)
+				return err
 			}
 
-			log.Print("Writing payload")
-			err = flywheel.WritePayload(payload, &crossplane.BuildOptions{})
+			log.Print("Replacing directive keys from etcd")
+			overrider, err := newEtcdProvider()
 			if err != nil {
-				msg := "failed to write to output"
-				log.Err(err).Msg(msg)
-				return fmt.Errorf(msg)
+				return err
 			}
+			defer overrider.Close()
 
-			return nil
+			if !watch {
+				return renderEtcd(ctx, source, overrider)
+			}
+			return watchEtcd(ctx, source, overrider)
 		},
 	}
 )
 
+// newEtcdClient connects to the etcd endpoints
+func newEtcdClient() (*clientv3.Client, error) {
+	client, err := clientv3.New(clientv3.Config{Endpoints: endpoints})
+	if err != nil {
+		msg := "failed to create etcd client"
+		log.Err(err).Strs("endpoints", endpoints).Msg(msg)
+		return nil, fmt.Errorf(msg)
+	}
+	return client, nil
+}
+
+// newEtcdProvider creates the provider from the etcd flags
+func newEtcdProvider() (*etcdp.Etcd3Provider, error) {
+	client, err := newEtcdClient()
+	if err != nil {
+		return nil, err
+	}
+	return &etcdp.Etcd3Provider{Client: client, LStrip: lstrip, AtRevision: revision}, nil
+}
+
+// renderEtcd renders the source and logs the etcd revision it was rendered from
+func renderEtcd(ctx context.Context, source *crossplane.Payload, overrider *etcdp.Etcd3Provider) error {
+	if err := render(ctx, source, overrider); err != nil {
+		return err
+	}
+	log.Info().Int64("revision", overrider.Revision()).Msg("Rendered from etcd")
+	return nil
+}
+
+// watchEtcd renders the source and then renders it again whenever its keys change
+//
+// The keys of the files are watched along with the keys a render resolved outside of them, such as those of
+// templates and `flywheel:key` annotations. Changes are debounced so a burst of updates produces a single render,
+// though a steady stream of them still renders once maxWait has passed since the first pending change. A failed
+// render is logged and the previous output is left in place until the next change.
+func watchEtcd(ctx context.Context, source *crossplane.Payload, overrider *etcdp.Etcd3Provider) error {
+	paths := configFiles(source)
+	// watch before the first render so changes made during it aren't missed
+	watchCtx, stopWatch := context.WithCancel(ctx)
+	defer func() { stopWatch() }()
+	changes := overrider.Changes(watchCtx, paths, nil, 0)
+	var watched []string
+	// rewatch adds the keys the last render resolved to the watch, from the revision after the one it rendered
+	rewatch := func() {
+		keys := overrider.ResolvedKeys()
+		if reflect.DeepEqual(keys, watched) || overrider.Revision() == 0 {
+			return
+		}
+		stopWatch()
+		watchCtx, stopWatch = context.WithCancel(ctx)
+		changes = overrider.Changes(watchCtx, paths, keys, overrider.Revision()+1)
+		watched = keys
+		log.Info().Strs("keys", keys).Msg("Watching resolved keys")
+	}
+	if err := renderEtcd(ctx, source, overrider); err != nil {
+		log.Warn().Msg("Initial render failed; waiting for changes")
+	}
+	rewatch()
+
+	log.Info().Strs("prefixes", overrider.Prefixes(paths)).Msg("Watching etcd")
+	var pending <-chan time.Time
+	// deadline is when the pending changes render even if more keep arriving
+	var deadline time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case resp, ok := <-changes:
+			if !ok {
+				if ctx.Err() != nil {
+					return nil
+				}
+				msg := "etcd watch closed"
+				log.Error().Msg(msg)
+				return fmt.Errorf(msg)
+			}
+			if err := resp.Err(); err != nil {
+				msg := "etcd watch failed"
+				log.Err(err).Msg(msg)
+				return fmt.Errorf(msg+": %w", err)
+			}
+			log.Debug().Int("events", len(resp.Events)).Int64("revision", resp.Header.Revision).Msg("Keys changed")
+			if pending == nil {
+				deadline = time.Now().Add(maxWait)
+			}
+			wait := debounce
+			if remaining := time.Until(deadline); maxWait > 0 && remaining < wait {
+				wait = remaining
+			}
+			pending = time.After(wait)
+		case <-pending:
+			pending = nil
+			if err := renderEtcd(ctx, source, overrider); err != nil {
+				log.Warn().Msg("Render failed; waiting for changes")
+			}
+			rewatch()
+		}
+	}
+}
+
 func init() {
 	rootCmd.AddCommand(etcdCmd)
+	etcdCmd.AddCommand(newKeysCmd(func() (flywheel.OverrideProvider, error) {
+		p, err := newEtcdProvider()
+		if err != nil {
+			return nil, err
+		}
+		return p, nil
+	}))
+	// render flags aren't persistent as they don't apply to subcommands such as import
+	addRenderFlags(etcdCmd.Flags())
 	// etcd flags
 	etcdCmd.PersistentFlags().StringSliceVar(&endpoints, "endpoint", nil, "etcd endpoints")
 	etcdCmd.PersistentFlags().StringVar(&lstrip, "lstrip", "/etc", "prefix to strip from absolute path to produce etcd key")
+	etcdCmd.Flags().BoolVar(&watch, "watch", false, "keep running and render again when keys change")
+	etcdCmd.Flags().Int64Var(&revision, "revision", 0, "render from this etcd revision instead of the latest")
+	etcdCmd.Flags().DurationVar(&debounce, "debounce", 2*time.Second, "quiet period after a change before rendering in watch mode")
+	etcdCmd.Flags().DurationVar(&maxWait, "max-wait", 30*time.Second, "longest to wait after a change before rendering in watch mode while changes keep arriving; 0 waits for a quiet period")
 }
@@ -0,0 +1,84 @@
+/*
+Copyright © 2020 Brian Williams
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/Brian-Williams/nginx_flywheel/pkg"
+	"github.com/Brian-Williams/nginx_flywheel/pkg/etcdp"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var (
+	skipExisting bool
+	maxTxnOps    int
+
+	// etcdImportCmd represents the etcd import command
+	etcdImportCmd = &cobra.Command{
+		Use:   "import",
+		Short: "Seed etcd with the current values of an NGINX file",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := signalContext()
+			defer cancel()
+
+			source, err := parseSource()
+			if err != nil {
+				return err
+			}
+
+			client, err := newEtcdClient()
+			if err != nil {
+				return err
+			}
+			provider := &etcdp.Etcd3Provider{Client: client, LStrip: lstrip, MaxTxnOps: maxTxnOps}
+			defer provider.Close()
+
+			values, duplicates, err := flywheel.CurrentValues(source, provider.Keys)
+			if err != nil {
+				msg := "failed to read current values"
+				log.Err(err).Msg(msg)
+				return fmt.Errorf(msg+": %w", err)
+			}
+			if len(duplicates) != 0 {
+				log.Warn().Strs("keys", duplicates).Msg("Skipping keys shared by directives in different blocks")
+			}
+
+			log.Print("Importing keys to etcd")
+			skipped, err := provider.Import(ctx, values, skipExisting)
+			if err != nil {
+				msg := "failed to import keys"
+				log.Err(err).Msg(msg)
+				return fmt.Errorf(msg+": %w", err)
+			}
+			if len(skipped) != 0 {
+				log.Info().Strs("keys", skipped).Msg("Skipped existing keys")
+			}
+			log.Info().Int("keys", len(values)-len(skipped)).Msg("Imported keys")
+
+			return nil
+		},
+	}
+)
+
+func init() {
+	etcdCmd.AddCommand(etcdImportCmd)
+	addSourceFlag(etcdImportCmd.Flags())
+	etcdImportCmd.Flags().BoolVar(&skipExisting, "skip-existing", false, "leave keys that already exist in etcd alone")
+	etcdImportCmd.Flags().IntVar(&maxTxnOps, "max-txn-ops", etcdp.DefaultMaxTxnOps, "most keys to write per transaction; must not exceed the --max-txn-ops of the etcd cluster")
+}
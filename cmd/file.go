@@ -0,0 +1,78 @@
+/*
+Copyright © 2020 Brian Williams
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/Brian-Williams/nginx_flywheel/pkg"
+	"github.com/Brian-Williams/nginx_flywheel/pkg/filep"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var (
+	overridesPath string
+
+	// fileCmd represents the file command
+	fileCmd = &cobra.Command{
+		Use:   "file",
+		Short: "Rewrite an NGINX file using a local YAML or JSON document as a variable provider",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := signalContext()
+			defer cancel()
+
+			if err := checkRenderFlags(); err != nil {
+				return err
+			}
+
+			source, err := parseSource()
+			if err != nil {
+				return err
+			}
+
+			log.Print("Replacing directive keys from file")
+			overrider, err := newFileProvider()
+			if err != nil {
+				return err
+			}
+			defer overrider.Close()
+
+			return render(ctx, source, overrider)
+		},
+	}
+)
+
+// newFileProvider creates the provider from the file flags
+func newFileProvider() (flywheel.OverrideProvider, error) {
+	overrides, err := filep.ReadFile(overridesPath)
+	if err != nil {
+		msg := "failed to read overrides file"
+		log.Err(err).Str("file", overridesPath).Msg(msg)
+		return nil, fmt.Errorf(msg+": %w", err)
+	}
+	return &filep.FileProvider{Overrides: overrides, LStrip: lstrip}, nil
+}
+
+func init() {
+	rootCmd.AddCommand(fileCmd)
+	fileCmd.AddCommand(newKeysCmd(newFileProvider))
+	addRenderFlags(fileCmd.Flags())
+	// file flags
+	fileCmd.PersistentFlags().StringVar(&overridesPath, "overrides", "", "YAML or JSON document of overrides by key")
+	fileCmd.PersistentFlags().StringVar(&lstrip, "lstrip", "/etc", "prefix to strip from absolute path to produce override key")
+}
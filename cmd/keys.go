@@ -0,0 +1,94 @@
+/*
+Copyright © 2020 Brian Williams
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/Brian-Williams/nginx_flywheel/pkg"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"sigs.k8s.io/yaml"
+)
+
+var keysOutput string
+
+// newKeysCmd creates a keys command that exports the key space of the provider made by newProvider
+func newKeysCmd(newProvider func() (flywheel.OverrideProvider, error)) *cobra.Command {
+	keysCmd := &cobra.Command{
+		Use:   "keys",
+		Short: "List every key looked up for an NGINX file and its current value",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := signalContext()
+			defer cancel()
+
+			source, err := parseSource()
+			if err != nil {
+				return err
+			}
+
+			provider, err := newProvider()
+			if err != nil {
+				return err
+			}
+			defer provider.Close()
+
+			entries, err := flywheel.ExportKeys(ctx, source, provider)
+			if err != nil {
+				msg := "failed to export keys"
+				log.Err(err).Msg(msg)
+				return fmt.Errorf(msg+": %w", err)
+			}
+			return printKeys(entries)
+		},
+	}
+	addSourceFlag(keysCmd.Flags())
+	keysCmd.Flags().StringVarP(&keysOutput, "output", "o", "table", "output format: table, json or yaml")
+	return keysCmd
+}
+
+// printKeys writes the entries to stdout in the keysOutput format
+func printKeys(entries []flywheel.KeyEntry) error {
+	if entries == nil {
+		entries = []flywheel.KeyEntry{}
+	}
+	switch keysOutput {
+	case "json":
+		e := json.NewEncoder(os.Stdout)
+		e.SetIndent("", "  ")
+		return e.Encode(entries)
+	case "yaml":
+		b, err := yaml.Marshal(entries)
+		if err != nil {
+			return fmt.Errorf("failed to marshal keys: %w", err)
+		}
+		_, err = os.Stdout.Write(b)
+		return err
+	case "table":
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "PROVIDER\tKEY\tEXISTS\tVALUE\tDIRECTIVES\tFIRST USED")
+		for _, e := range entries {
+			fmt.Fprintf(w, "%d\t%s\t%t\t%s\t%d\t%s:%d\n", e.Provider, e.Key, e.Exists, e.Value, e.Directives, e.File, e.Line)
+		}
+		return w.Flush()
+	default:
+		return fmt.Errorf("unknown output format: %q", keysOutput)
+	}
+}
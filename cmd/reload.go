@@ -0,0 +1,103 @@
+/*
+Copyright © 2020 Brian Williams
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"github.com/Brian-Williams/nginx_flywheel/pkg"
+	"github.com/aluttik/go-crossplane"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/pflag"
+)
+
+var (
+	reload      bool
+	pidFile     string
+	nginxPrefix string
+	nginxBin    string
+	reloadCmd   string
+)
+
+// reloadNginx reloads NGINX after the payload has been written
+//
+// reloadCmd wins over pidFile, which wins over the pid directive of the payload.
+func reloadNginx(ctx context.Context, payload *crossplane.Payload) error {
+	command, err := flywheel.SplitArgs(reloadCmd)
+	if err != nil {
+		msg := "failed to parse --reload-cmd"
+		log.Err(err).Str("reload_cmd", reloadCmd).Msg(msg)
+		return fmt.Errorf(msg+": %w", err)
+	}
+	reloader := flywheel.Reloader{PidFile: pidFile, Command: command}
+	if len(reloader.Command) == 0 && reloader.PidFile == "" {
+		pid, err := configPidFile(ctx, payload)
+		if err != nil {
+			return err
+		}
+		reloader.PidFile = pid
+	}
+
+	log.Print("Reloading NGINX")
+	if err = reloader.Reload(ctx); err != nil {
+		msg := "failed to reload NGINX"
+		log.Err(err).Str("pid_file", reloader.PidFile).Strs("command", reloader.Command).Msg(msg)
+		return fmt.Errorf(msg+": %w", err)
+	}
+	log.Info().Str("pid_file", reloader.PidFile).Strs("command", reloader.Command).Msg("Reloaded NGINX")
+
+	return nil
+}
+
+// configPidFile finds the pid file NGINX uses for the payload
+//
+// A relative pid directive, or no pid directive, depends on the prefix NGINX was built with, which is read from
+// `nginx -V` unless nginxPrefix is set. With nginxPrefix and no pid directive NGINX's default logs/nginx.pid is used.
+func configPidFile(ctx context.Context, payload *crossplane.Payload) (string, error) {
+	pid, ok := flywheel.PidFile(payload, nginxPrefix)
+	if ok && (filepath.IsAbs(pid) || nginxPrefix != "") {
+		return pid, nil
+	}
+	if nginxPrefix != "" {
+		return filepath.Join(nginxPrefix, flywheel.DefaultNginxPidPath), nil
+	}
+	build, err := flywheel.ReadNginxBuild(ctx, nginxBin)
+	if err != nil {
+		msg := "failed to read the NGINX prefix; set --nginx-prefix, --pid-file or --reload-cmd"
+		log.Err(err).Str("nginx_bin", nginxBin).Msg(msg)
+		return "", fmt.Errorf(msg+": %w", err)
+	}
+	prefix := build.Prefix
+	if pid, ok = flywheel.PidFile(payload, prefix); ok {
+		return pid, nil
+	}
+	pid = build.PidPath
+	if !filepath.IsAbs(pid) {
+		pid = filepath.Join(prefix, pid)
+	}
+	return pid, nil
+}
+
+// addReloadFlags adds the flags that control reloading NGINX
+func addReloadFlags(fs *pflag.FlagSet) {
+	fs.BoolVar(&reload, "reload", false, "reload NGINX after the config is written, rolling it back if the reload fails")
+	fs.StringVar(&pidFile, "pid-file", "", "pid file of the NGINX master process (default is the pid directive of the config)")
+	fs.StringVar(&nginxPrefix, "nginx-prefix", "", "NGINX prefix to resolve a relative pid directive against, as given to nginx -p (default is read from --nginx-bin -V)")
+	fs.StringVar(&nginxBin, "nginx-bin", "nginx", "NGINX binary to read the compile time prefix and pid path from")
+	fs.StringVar(&reloadCmd, "reload-cmd", "", "command to reload NGINX instead of signalling the master process, e.g. 'nginx -s reload'")
+}
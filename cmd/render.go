@@ -0,0 +1,370 @@
+/*
+Copyright © 2020 Brian Williams
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Brian-Williams/nginx_flywheel/pkg"
+	"github.com/aluttik/go-crossplane"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/pflag"
+)
+
+var (
+	validate      bool
+	validateCmd   string
+	dryRun        bool
+	collectErrors bool
+	templates     bool
+	strict        bool
+	rulesPath     string
+
+	backupDir      string
+	backupKeep     int
+	backupKeepDays int
+)
+
+// signalContext produces a context that is cancelled on SIGINT or SIGTERM
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case s := <-sigs:
+			log.Info().Str("signal", s.String()).Msg("Shutting down")
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(sigs)
+	}()
+	return ctx, cancel
+}
+
+// parseSource parses the NGINX config at sourcePath
+func parseSource() (*crossplane.Payload, error) {
+	log.Debug().
+		Str("path", sourcePath).
+		Msg("Parsing file")
+	payload, err := crossplane.Parse(sourcePath, &crossplane.ParseOptions{ParseComments: true})
+	if err != nil {
+		msg := "failed to parse source file"
+		log.Err(err).Str("file", sourcePath).Msg(msg)
+		return nil, fmt.Errorf(msg+": %w", err)
+	}
+	return payload, nil
+}
+
+// configFiles lists the files of the payload
+func configFiles(p *crossplane.Payload) []string {
+	files := make([]string, len(p.Config))
+	for i, c := range p.Config {
+		files[i] = c.File
+	}
+	return files
+}
+
+// checkRenderFlags rejects combinations of the render flags that would lose the source config
+func checkRenderFlags() error {
+	if templates && destPath == "" && !dryRun {
+		// rendering over the source would replace its templates with their values for good
+		msg := "--templates requires --destination so the source keeps its templates"
+		log.Error().Msg(msg)
+		return fmt.Errorf(msg)
+	}
+	return nil
+}
+
+// render overrides a copy of the source payload and installs it
+//
+// The payload is validated from a staged copy before anything is installed, and the installation is rolled back if
+// reload fails. The source payload is left untouched so it can be rendered again.
+func render(ctx context.Context, source *crossplane.Payload, overrider flywheel.OverrideProvider) error {
+	payload, err := flywheel.CopyPayload(source)
+	if err != nil {
+		msg := "failed to copy source payload"
+		log.Err(err).Msg(msg)
+		return fmt.Errorf(msg)
+	}
+
+	if rulesPath != "" {
+		if err = applyRules(payload); err != nil {
+			return err
+		}
+	}
+
+	log.Print("Overriding directives")
+	err = flywheel.OverridePayload(ctx, payload, overrider, &flywheel.OverrideOptions{
+		CollectErrors: collectErrors,
+		Templates:     templates,
+		Strict:        strict,
+	})
+	if err != nil {
+		msg := "overriding NGINX JSON failed"
+		var errs flywheel.OverrideErrors
+		var dErr *flywheel.DirectiveError
+		var missing *flywheel.MissingKeysError
+		switch {
+		case errors.As(err, &missing):
+			msg = "required directives weren't overridden"
+			for _, e := range missing.Directives {
+				logDirectiveError(e, msg)
+			}
+			log.Error().Strs("keys", missing.Keys).Msg("Missing keys")
+		case errors.As(err, &errs):
+			for _, e := range errs {
+				logDirectiveError(e, msg)
+			}
+		case errors.As(err, &dErr):
+			logDirectiveError(dErr, msg)
+		default:
+			log.Err(err).Msg(msg)
+		}
+		return fmt.Errorf(msg+": %w", err)
+	}
+	if v, ok := overrider.(flywheel.Versioned); ok && v.Version() != "" {
+		flywheel.SetHeader(payload, "rendered from "+v.Version())
+	}
+
+	if destPath != "" {
+		log.Debug().Str("destination", destPath).Msg("Relocating payload")
+		if err = flywheel.RelocatePayload(payload, destPath); err != nil {
+			msg := "failed to relocate payload to destination"
+			log.Err(err).Str("destination", destPath).Msg(msg)
+			return fmt.Errorf(msg+": %w", err)
+		}
+	}
+
+	if dryRun {
+		return diffPayload(payload)
+	}
+
+	if validate {
+		if err = validatePayload(ctx, payload); err != nil {
+			return err
+		}
+	}
+
+	if backupDir != "" {
+		if err = backupPayload(payload); err != nil {
+			return err
+		}
+	}
+
+	log.Print("Installing payload")
+	inst, err := flywheel.InstallPayload(payload, &crossplane.BuildOptions{})
+	if err != nil {
+		msg := "failed to install rendered config"
+		log.Err(err).Msg(msg)
+		return fmt.Errorf(msg+": %w", err)
+	}
+	log.Debug().Strs("files", inst.Files()).Msg("Installed files")
+
+	if reload {
+		if err = reloadNginx(ctx, payload); err != nil {
+			rollback(inst)
+			return err
+		}
+	}
+
+	if err = inst.Commit(); err != nil {
+		log.Warn().Err(err).Msg("Installed config but failed to clean up backups")
+	}
+	return nil
+}
+
+// backupStore is the store configured by the backup flags
+func backupStore() flywheel.BackupStore {
+	return flywheel.BackupStore{
+		Dir:      backupDir,
+		KeepLast: backupKeep,
+		KeepFor:  time.Duration(backupKeepDays) * 24 * time.Hour,
+	}
+}
+
+// backupPayload keeps the current version of every file the payload replaces as a new generation
+func backupPayload(payload *crossplane.Payload) error {
+	gen, err := backupStore().Backup(configFiles(payload))
+	if err != nil {
+		msg := "failed to back up current config"
+		log.Err(err).Str("backup_dir", backupDir).Msg(msg)
+		return fmt.Errorf(msg+": %w", err)
+	}
+	log.Info().Str("generation", gen.ID).Str("backup_dir", backupDir).Msg("Backed up current config")
+	return nil
+}
+
+// rollback restores the config an installation replaced after a later step failed
+func rollback(inst *flywheel.Installation) {
+	log.Warn().Strs("files", inst.Files()).Msg("Rolling back installed config")
+	if err := inst.Rollback(); err != nil {
+		log.Err(err).Msg("failed to roll back installed config")
+	}
+}
+
+// applyRules applies the rules file to the payload, before any provider overrides it
+func applyRules(payload *crossplane.Payload) error {
+	rules, err := flywheel.ReadRules(rulesPath)
+	if err != nil {
+		msg := "failed to read rules file"
+		log.Err(err).Str("file", rulesPath).Msg(msg)
+		return fmt.Errorf(msg+": %w", err)
+	}
+	log.Print("Applying rules")
+	counts, err := flywheel.ApplyRules(payload, rules)
+	if err != nil {
+		msg := "failed to apply rules"
+		log.Err(err).Str("file", rulesPath).Msg(msg)
+		return fmt.Errorf(msg+": %w", err)
+	}
+	for i, count := range counts {
+		if count == 0 {
+			log.Warn().Str("select", rules[i].Select).Msg("Rule matched no directives")
+			continue
+		}
+		log.Debug().Str("select", rules[i].Select).Int("directives", count).Msg("Applied rule")
+	}
+	return nil
+}
+
+// logDirectiveError logs where a directive failed to override
+func logDirectiveError(err *flywheel.DirectiveError, msg string) {
+	log.Err(err.Err).
+		Str("file", err.File).
+		Int("line", err.Line).
+		Str("block_path", err.BlockPath).
+		Msg(msg)
+}
+
+// diffPayload prints a unified diff of every file the payload would change without writing anything
+//
+// An error is returned when there are differences so dry runs can be used as a drift check.
+func diffPayload(payload *crossplane.Payload) error {
+	diffs, err := flywheel.DiffPayload(payload, &crossplane.BuildOptions{})
+	if err != nil {
+		msg := "failed to diff payload"
+		log.Err(err).Msg(msg)
+		return fmt.Errorf(msg)
+	}
+	if len(diffs) == 0 {
+		log.Print("No changes")
+		return nil
+	}
+	files := make([]string, len(diffs))
+	for i, d := range diffs {
+		files[i] = d.File
+		fmt.Fprint(os.Stdout, d.Diff)
+	}
+	msg := "rendered config differs from current config"
+	log.Warn().Strs("files", files).Msg(msg)
+	return fmt.Errorf(msg)
+}
+
+// validator is the Validator configured by validateCmd
+//
+// The command is split like a shell would, so an argument with spaces can be quoted.
+func validator() (flywheel.Validator, error) {
+	command, err := flywheel.SplitArgs(validateCmd)
+	if err != nil {
+		msg := "invalid --validate-cmd"
+		log.Err(err).Str("validate_cmd", validateCmd).Msg(msg)
+		return flywheel.Validator{}, fmt.Errorf(msg+": %w", err)
+	}
+	return flywheel.Validator{Command: command}, nil
+}
+
+// validatePayload validates a staged copy of the payload with validateCmd, so nothing is installed until it passes
+func validatePayload(ctx context.Context, payload *crossplane.Payload) error {
+	v, err := validator()
+	if err != nil {
+		return err
+	}
+	log.Print("Validating payload")
+	if err = flywheel.ValidatePayload(ctx, payload, &crossplane.BuildOptions{}, v); err != nil {
+		logValidationError(err, v)
+		return fmt.Errorf("rendered config failed validation: %w", err)
+	}
+	return nil
+}
+
+// validateInstalled validates the installed main config with validateCmd
+//
+// The config is validated in place so includes resolve exactly as NGINX will load them; the caller rolls back
+// when it's rejected.
+func validateInstalled(ctx context.Context, mainConfig string) error {
+	v, err := validator()
+	if err != nil {
+		return err
+	}
+	log.Print("Validating config")
+	if err = v.Validate(ctx, mainConfig); err != nil {
+		logValidationError(err, v)
+		return fmt.Errorf("config failed validation: %w", err)
+	}
+	return nil
+}
+
+// logValidationError logs the output of the validator when it rejects a config
+func logValidationError(err error, v flywheel.Validator) {
+	msg := "config failed validation"
+	var vErr *flywheel.ValidationError
+	if errors.As(err, &vErr) {
+		log.Err(vErr.Err).Strs("command", v.Command).Str("output", vErr.Output).Msg(msg)
+	} else {
+		log.Err(err).Msg(msg)
+	}
+}
+
+// addSourceFlag adds the flag for the NGINX config to read
+func addSourceFlag(fs *pflag.FlagSet) {
+	fs.StringVar(&sourcePath, "source", "", "absolute path of NGINX config file")
+}
+
+// addRenderFlags adds the flags shared by every command that renders a config
+func addRenderFlags(fs *pflag.FlagSet) {
+	addSourceFlag(fs)
+	fs.StringVar(&destPath, "destination", "", "directory to mirror the rendered include tree into (default overwrites the source files); warning: This will truncate any existing files")
+	fs.BoolVar(&collectErrors, "collect-errors", false, "report every directive that fails to override instead of stopping at the first")
+	fs.BoolVar(&strict, "strict", false, "fail listing the missing keys when a directive annotated '# flywheel:required' isn't overridden")
+	fs.StringVar(&rulesPath, "rules", "", "YAML or JSON file of rules applying operations to the directives their selectors match, before the provider overrides")
+	fs.BoolVar(&templates, "templates", false, "resolve template expressions within args, e.g. '{{ key \"/upstreams/api/port\" | default \"8080\" }}'; requires --destination unless --dry-run so the source keeps its templates")
+	// dry run flags
+	fs.BoolVar(&dryRun, "dry-run", false, "print a diff of the changes instead of writing them; exits non-zero when there are changes")
+	addValidateFlags(fs)
+	addBackupFlags(fs)
+	addReloadFlags(fs)
+}
+
+// addValidateFlags adds the flags that control validating an installed config
+func addValidateFlags(fs *pflag.FlagSet) {
+	fs.BoolVar(&validate, "validate", false, "validate the config with --validate-cmd, leaving the installed files as they were if it's rejected")
+	fs.StringVar(&validateCmd, "validate-cmd", strings.Join(flywheel.DefaultValidateCommand, " "), "command to validate the config; the main config path is appended")
+}
+
+// addBackupFlags adds the flags for keeping generations of replaced configs
+func addBackupFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&backupDir, "backup-dir", "", "directory to keep a timestamped generation of the replaced files in before installing (default no backups)")
+	fs.IntVar(&backupKeep, "backup-keep", 0, "number of backup generations to keep (default keeps all)")
+	fs.IntVar(&backupKeepDays, "backup-keep-days", 0, "days to keep backup generations for (default keeps all)")
+}
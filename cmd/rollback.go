@@ -0,0 +1,116 @@
+/*
+Copyright © 2020 Brian Williams
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aluttik/go-crossplane"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var (
+	generation      string
+	listGenerations bool
+
+	// rollbackCmd represents the rollback command
+	rollbackCmd = &cobra.Command{
+		Use:   "rollback",
+		Short: "Restore a generation of NGINX files kept by --backup-dir",
+		Long: `Restore a generation of NGINX files kept by --backup-dir, the newest by default.
+
+The files being replaced are first kept as a new generation, so a rollback can itself be rolled back. The restored
+files are validated and NGINX reloaded when requested; if either fails the files the rollback replaced are put
+back.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := signalContext()
+			defer cancel()
+
+			if backupDir == "" {
+				return fmt.Errorf("--backup-dir is required")
+			}
+			store := backupStore()
+			if listGenerations {
+				gens, err := store.Generations()
+				if err != nil {
+					msg := "failed to list generations"
+					log.Err(err).Str("backup_dir", backupDir).Msg(msg)
+					return fmt.Errorf(msg+": %w", err)
+				}
+				w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+				fmt.Fprintln(w, "GENERATION\tTIME\tFILES")
+				for _, gen := range gens {
+					fmt.Fprintf(w, "%s\t%s\t%d\n", gen.ID, gen.Time.Local().Format(time.RFC3339), len(gen.Files))
+				}
+				return w.Flush()
+			}
+
+			log.Print("Restoring generation")
+			gen, backup, inst, err := store.Restore(generation)
+			if backup.ID != "" {
+				log.Info().Str("generation", backup.ID).Str("backup_dir", backupDir).Msg("Backed up current config")
+			}
+			if err != nil {
+				msg := "failed to restore generation"
+				log.Err(err).Str("backup_dir", backupDir).Str("generation", generation).Msg(msg)
+				return fmt.Errorf(msg+": %w", err)
+			}
+			log.Info().Str("generation", gen.ID).Strs("files", inst.Files()).Msg("Restored generation")
+			if len(gen.Files) == 0 {
+				return inst.Commit()
+			}
+
+			mainConfig := gen.Files[0].Path
+			if validate {
+				if err = validateInstalled(ctx, mainConfig); err != nil {
+					rollback(inst)
+					return err
+				}
+			}
+			if reload {
+				payload, err := crossplane.Parse(mainConfig, &crossplane.ParseOptions{SingleFile: true})
+				if err != nil {
+					msg := "failed to parse restored config"
+					log.Err(err).Str("file", mainConfig).Msg(msg)
+					rollback(inst)
+					return fmt.Errorf(msg+": %w", err)
+				}
+				if err = reloadNginx(ctx, payload); err != nil {
+					rollback(inst)
+					return err
+				}
+			}
+
+			if err = inst.Commit(); err != nil {
+				log.Warn().Err(err).Msg("Restored generation but failed to clean up backups")
+			}
+			return nil
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(rollbackCmd)
+	rollbackCmd.Flags().StringVar(&backupDir, "backup-dir", "", "directory the generations were kept in")
+	rollbackCmd.Flags().StringVar(&generation, "generation", "", "generation to restore (default newest)")
+	rollbackCmd.Flags().BoolVar(&listGenerations, "list", false, "list the generations instead of restoring one")
+	addValidateFlags(rollbackCmd.Flags())
+	addReloadFlags(rollbackCmd.Flags())
+}
@@ -52,7 +52,8 @@ func Execute() {
 }
 
 func init() {
-	output := zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339}
+	// log to stderr so stdout only carries command output such as diffs and keys
+	output := zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.RFC3339}
 	output.FormatLevel = func(i interface{}) string {
 		return strings.ToUpper(fmt.Sprintf("| %-6s|", i))
 	}
@@ -63,10 +64,6 @@ func init() {
 
 	cobra.OnInitialize(initConfig)
 
-	// file flags
-	etcdCmd.PersistentFlags().StringVar(&sourcePath, "source", "", "absolute path of NGINX config file")
-	etcdCmd.PersistentFlags().StringVar(&destPath, "destination", "", "location to write overwritten values; warning: This will truncate any existing file")
-
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.nginx_flywheel.yaml)")
 }
 
@@ -8,8 +8,11 @@ require (
 	github.com/dustin/go-humanize v1.0.0 // indirect
 	github.com/google/uuid v1.1.2 // indirect
 	github.com/mitchellh/go-homedir v1.1.0
+	github.com/pmezard/go-difflib v1.0.0
 	github.com/rs/zerolog v1.20.0
 	github.com/spf13/cobra v1.1.1
+	github.com/spf13/pflag v1.0.5
 	github.com/spf13/viper v1.7.1
-	sigs.k8s.io/yaml v1.2.0 // indirect
+	gopkg.in/yaml.v2 v2.2.8
+	sigs.k8s.io/yaml v1.2.0
 )
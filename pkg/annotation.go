@@ -0,0 +1,171 @@
+package flywheel
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/aluttik/go-crossplane"
+)
+
+// annotationComment matches a comment that controls how flywheel treats a directive, e.g. `# flywheel:required`
+//
+// Only the exact `flywheel:<name>[=value]` form is an annotation, so prose such as `# flywheel: managed file` isn't.
+var annotationComment = regexp.MustCompile(`^flywheel:([a-z][a-z_-]*)(=(.*))?$`)
+
+// annotations are the flywheel comments attached to a directive
+//
+//	flywheel:required       fails a strict run when no provider overrides the directive
+//	flywheel:skip           leaves the directive, and everything nested in it, as is
+//	flywheel:key=/some/key  looks up the key instead of the keys derived from the path of the directive
+//	flywheel:default=value  applies the value, decoded like a stored one, when no provider overrides the directive
+type annotations struct {
+	required bool
+	skip     bool
+	// key replaces the keys derived from the path of the directive when it isn't empty
+	key string
+	// defaultOp is applied when no provider overrides the directive
+	defaultOp *Operation
+}
+
+// directiveAnnotations parses the annotation comments attached to ds[i]
+//
+// A comment is attached to the directive it trails on the same line, including the first comments of a block
+// opened on that line, or to the directive it precedes with no lines in between, like:
+//
+//	# flywheel:required
+//	listen 80;
+//	server_name example.com; # flywheel:required
+//
+// parentLine is the line of the block directive enclosing ds, or 0; comments on that line belong to the parent.
+// An unknown annotation is an error so a typo can't silently disable it.
+func directiveAnnotations(ds []crossplane.Directive, i int, parentLine int) (annotations, error) {
+	d := ds[i]
+	var comments []crossplane.Directive
+	line := d.Line
+	for j := i - 1; j >= 0 && ds[j].IsComment() && ds[j].Line == line-1 && ds[j].Line != parentLine; j-- {
+		if j > 0 && !ds[j-1].IsComment() && ds[j-1].Line == ds[j].Line {
+			// trails the previous directive
+			break
+		}
+		comments = append(comments, ds[j])
+		line = ds[j].Line
+	}
+	for j := i + 1; j < len(ds) && ds[j].IsComment() && ds[j].Line == d.Line; j++ {
+		comments = append(comments, ds[j])
+	}
+	if d.Block != nil {
+		for _, c := range *d.Block {
+			if !c.IsComment() || c.Line != d.Line {
+				break
+			}
+			comments = append(comments, c)
+		}
+	}
+
+	var a annotations
+	for _, c := range comments {
+		if c.Comment == nil {
+			continue
+		}
+		text := strings.TrimSpace(*c.Comment)
+		m := annotationComment.FindStringSubmatch(text)
+		if m == nil {
+			continue
+		}
+		name, value, hasValue := m[1], m[3], m[2] != ""
+		switch name {
+		case "required", "skip":
+			if hasValue {
+				return annotations{}, fmt.Errorf("annotation %q doesn't take a value", text)
+			}
+			a.required = a.required || name == "required"
+			a.skip = a.skip || name == "skip"
+		case "key":
+			value = strings.TrimSpace(value)
+			if value == "" {
+				return annotations{}, fmt.Errorf("annotation %q needs a key", text)
+			}
+			a.key = value
+		case "default":
+			if !hasValue {
+				return annotations{}, fmt.Errorf("annotation %q needs a value", text)
+			}
+			op, err := DecodeOperation([]byte(value))
+			if err != nil {
+				return annotations{}, fmt.Errorf("invalid default in annotation %q: %w", text, err)
+			}
+			a.defaultOp = &op
+		default:
+			return annotations{}, fmt.Errorf("unknown annotation: %q", text)
+		}
+	}
+	if a.skip && a.required {
+		return annotations{}, fmt.Errorf("a skipped directive can't be required")
+	}
+	return a, nil
+}
+
+// walkAnnotated calls fn with the annotations of every directive of the payload that isn't a comment, parents
+// before their blocks
+//
+// The blocks of skipped directives aren't walked, since nothing within them is overridden. An invalid annotation
+// is returned as a *DirectiveError.
+func walkAnnotated(p *crossplane.Payload, fn func(ref DirectiveRef, d *crossplane.Directive, a annotations) error) error {
+	for i := range p.Config {
+		c := &p.Config[i]
+		if err := walkAnnotatedDirectives(c.Parsed, c.File, nil, 0, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func walkAnnotatedDirectives(ds []crossplane.Directive, abspath string, blocks []string, parentLine int, fn func(ref DirectiveRef, d *crossplane.Directive, a annotations) error) error {
+	for i := range ds {
+		d := &ds[i]
+		if d.IsComment() {
+			continue
+		}
+		a, err := directiveAnnotations(ds, i, parentLine)
+		if err != nil {
+			return newDirectiveError(d, abspath, blocks, err)
+		}
+		if err = fn(DirectiveRef{Directive: d.Directive, Path: abspath, Blocks: blocks}, d, a); err != nil {
+			return err
+		}
+		if d.Block != nil && !a.skip {
+			err = walkAnnotatedDirectives(*d.Block, abspath, append(blocks[:len(blocks):len(blocks)], BlockName(*d)), d.Line, fn)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// requiredKeys are the most specific keys each keyed provider looks up for ref, which a required directive is missing
+//
+// A custom key from a `flywheel:key` annotation is the only key looked up, as each provider maps it.
+func requiredKeys(o OverrideProvider, ref DirectiveRef, a annotations) []string {
+	switch p := o.(type) {
+	case *Chain:
+		var keys []string
+		for _, provider := range p.Providers {
+			keys = append(keys, requiredKeys(provider, ref, a)...)
+		}
+		return keys
+	case KeyedProvider:
+		if a.key != "" {
+			return []string{p.Key(a.key)}
+		}
+		if keys := p.Keys(ref); len(keys) != 0 {
+			return keys[:1]
+		}
+	default:
+		if a.key != "" {
+			return []string{a.key}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package flywheel
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/aluttik/go-crossplane"
+)
+
+const annotatedConfig = `# flywheel:required
+worker_processes 5;
+error_log logs/error.log; # flywheel:required
+pid logs/nginx.pid;
+
+events { # flywheel:required
+  # flywheel:required
+  worker_connections 4096;
+  use epoll;
+}
+`
+
+// parseAnnotated parses a config with its comments from a tmpdir
+func parseAnnotated(t *testing.T, config string) *crossplane.Payload {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "nginx-flywheel-test-")
+	if err != nil {
+		t.Fatalf("failed to create tmpdir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "nginx.conf")
+	if err = ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	payload, err := crossplane.Parse(path, &crossplane.ParseOptions{ParseComments: true})
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	return payload
+}
+
+func TestDirectiveAnnotations(t *testing.T) {
+	payload := parseAnnotated(t, annotatedConfig)
+	required := make(map[string]bool)
+	var walk func(ds []crossplane.Directive, parentLine int)
+	walk = func(ds []crossplane.Directive, parentLine int) {
+		for i, d := range ds {
+			if d.IsComment() {
+				continue
+			}
+			a, err := directiveAnnotations(ds, i, parentLine)
+			if err != nil {
+				t.Fatalf("failed to parse annotations of %v: %v", d.Directive, err)
+			}
+			required[d.Directive] = a.required
+			if d.Block != nil {
+				walk(*d.Block, d.Line)
+			}
+		}
+	}
+	walk(payload.Config[0].Parsed, 0)
+
+	expected := map[string]bool{
+		"worker_processes":   true,
+		"error_log":          true,
+		"pid":                false,
+		"events":             true,
+		"worker_connections": true,
+		"use":                false,
+	}
+	if !reflect.DeepEqual(required, expected) {
+		t.Errorf("expected %v got %v", expected, required)
+	}
+
+	for _, annotation := range []string{"requried", "skip=true", "key=", "default", "default=", "default=  ", "default={\"op\": \"nope\"}"} {
+		payload = parseAnnotated(t, "worker_processes 5; # flywheel:"+annotation+"\n")
+		if _, err := directiveAnnotations(payload.Config[0].Parsed, 0, 0); err == nil {
+			t.Errorf("expected %q to fail", annotation)
+		}
+	}
+
+	payload = parseAnnotated(t, "# flywheel:skip\nworker_processes 5; # flywheel:required\n")
+	if _, err := directiveAnnotations(payload.Config[0].Parsed, 1, 0); err == nil {
+		t.Errorf("expected a skipped directive that's required to fail")
+	}
+
+	payload = parseAnnotated(t, "# flywheel: managed file\nworker_processes 5; # flywheel:key = /workers\n")
+	if a, err := directiveAnnotations(payload.Config[0].Parsed, 1, 0); err != nil || a != (annotations{}) {
+		t.Errorf("expected comments that aren't annotations to be ignored got %+v: %v", a, err)
+	}
+}
+
+func TestOverridePayloadStrict(t *testing.T) {
+	payload := parseAnnotated(t, annotatedConfig)
+	k := keyedProvider{KeyScheme: KeyScheme{LStrip: filepath.Dir(payload.Config[0].File)}, values: map[string]string{
+		"/nginx/worker_processes": "auto",
+		"/nginx/events":           `{"op": "insert", "directives": [{"directive": "multi_accept", "args": ["on"]}]}`,
+	}}
+
+	original, err := CopyPayload(payload)
+	if err != nil {
+		t.Fatalf("failed to copy payload: %v", err)
+	}
+	if err = OverridePayload(context.Background(), original, k, nil); err != nil {
+		t.Errorf("expected required annotations to be ignored unless strict: %v", err)
+	}
+
+	err = OverridePayload(context.Background(), payload, k, &OverrideOptions{Strict: true})
+	var missing *MissingKeysError
+	if !errors.As(err, &missing) {
+		t.Fatalf("expected missing keys got: %v", err)
+	}
+	expected := []string{"/nginx/error_log", "/nginx/events/worker_connections"}
+	if !reflect.DeepEqual(missing.Keys, expected) {
+		t.Errorf("expected keys %v got %v", expected, missing.Keys)
+	}
+	if len(missing.Directives) != 2 || missing.Directives[1].Line != 8 {
+		t.Errorf("unexpected directives: %v", missing.Directives)
+	}
+
+	payload = parseAnnotated(t, "# flywheel:required\n# flywheel:key=/shared/error_log\nerror_log logs/error.log;\n")
+	err = OverridePayload(context.Background(), payload, keyedProvider{prefix: "prefix"}, &OverrideOptions{Strict: true})
+	if !errors.As(err, &missing) || !reflect.DeepEqual(missing.Keys, []string{"prefix/shared/error_log"}) {
+		t.Errorf("expected the custom key as the provider stores it got: %v", err)
+	}
+
+	payload = parseAnnotated(t, "# flywheel:required\nworker_processes '{{ key \"/workers\" }}';\n")
+	r := resolverProvider{"/workers": Replace("4")}
+	if err = OverridePayload(context.Background(), payload, r, &OverrideOptions{Strict: true, Templates: true}); err != nil {
+		t.Errorf("expected a resolved template to count as an override: %v", err)
+	}
+}
+
+func TestOverridePayloadAnnotations(t *testing.T) {
+	payload := parseAnnotated(t, `worker_processes 5; # flywheel:skip
+# flywheel:key=/shared/error_log
+error_log logs/error.log;
+pid logs/nginx.pid; # flywheel:default=/run/nginx.pid
+
+events { # flywheel:skip
+  worker_connections 1024;
+}
+http {
+  # flywheel:default=["on"]
+  # flywheel:key=/missing
+  sendfile off;
+  server {
+    listen 80; # flywheel:default=[::]:80
+  }
+}
+`)
+	o := &Chain{Providers: []OverrideProvider{
+		opProvider{
+			"worker_processes":          Replace("auto"),
+			"error_log":                 {Op: OpDelete},
+			"events/worker_connections": Replace("4096"),
+		},
+		resolverProvider{"/shared/error_log": Replace("stderr", "warn")},
+	}}
+	if err := OverridePayload(context.Background(), payload, o, nil); err != nil {
+		t.Fatalf("failed to override payload: %v", err)
+	}
+
+	args := make(map[string][]string)
+	err := WalkPayload(payload, func(ref DirectiveRef, d *crossplane.Directive) error {
+		args[ref.BlockPath()] = d.Args
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to walk payload: %v", err)
+	}
+	expected := map[string][]string{
+		"worker_processes":            {"5"},
+		"error_log":                   {"stderr", "warn"},
+		"pid":                         {"/run/nginx.pid"},
+		"events":                      {},
+		"events/worker_connections":   {"1024"},
+		"http":                        {},
+		"http/sendfile":               {"on"},
+		"http/server":                 {},
+		"http/server[[::]:80]/listen": {"[::]:80"},
+	}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("expected %v got %v", expected, args)
+	}
+
+	payload = parseAnnotated(t, "# flywheel:key=/shared/error_log\nerror_log logs/error.log;\n")
+	if err = OverridePayload(context.Background(), payload, opProvider{}, nil); err == nil {
+		t.Errorf("expected a custom key to fail when the provider can't resolve keys")
+	}
+}
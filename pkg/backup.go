@@ -0,0 +1,264 @@
+package flywheel
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// generationFormat names generation directories so they sort by age
+const generationFormat = "20060102T150405.000000000Z"
+
+// manifestName is the file in each generation describing what it holds
+const manifestName = "manifest.json"
+
+// BackupStore keeps timestamped generations of the files a render replaces
+//
+// Each generation is a directory under Dir holding a manifest and a copy of every file by its absolute path:
+//
+//	20201018T150405.000000000Z/manifest.json
+//	20201018T150405.000000000Z/files/etc/nginx/nginx.conf
+//
+// A generation is pruned once it's beyond KeepLast or older than KeepFor; zero values keep every generation.
+type BackupStore struct {
+	// Dir holds the generations
+	Dir string
+	// KeepLast is how many generations to keep
+	KeepLast int
+	// KeepFor is how long to keep generations
+	KeepFor time.Duration
+	// Now is the current time, defaults to time.Now
+	Now func() time.Time
+}
+
+// Generation is a backup of the files replaced by one render
+type Generation struct {
+	ID    string       `json:"id"`
+	Time  time.Time    `json:"time"`
+	Files []BackupFile `json:"files"`
+}
+
+// BackupFile is a file in a Generation
+type BackupFile struct {
+	// Path is the absolute path the file was backed up from
+	Path string `json:"path"`
+	// Exists is false when there was no file, so restoring removes it
+	Exists bool `json:"exists"`
+}
+
+func (s BackupStore) now() time.Time {
+	if s.Now != nil {
+		return s.Now()
+	}
+	return time.Now()
+}
+
+// Backup copies the current version of each path into a new generation and prunes old generations
+//
+// paths should list the main config first, as in a payload, so the generation can be validated and reloaded
+// after it's restored. Paths that don't exist are recorded so restoring the generation removes them.
+func (s BackupStore) Backup(paths []string) (Generation, error) {
+	now := s.now().UTC()
+	gen := Generation{ID: now.Format(generationFormat), Time: now}
+	dir := filepath.Join(s.Dir, gen.ID)
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return Generation{}, fmt.Errorf("failed to create backup directory: %w", err)
+	}
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return Generation{}, fmt.Errorf("failed to create generation: %w", err)
+	}
+	for _, path := range paths {
+		abspath, err := filepath.Abs(path)
+		if err != nil {
+			os.RemoveAll(dir)
+			return Generation{}, fmt.Errorf("failed to resolve %v: %w", path, err)
+		}
+		exists, err := copyFile(abspath, filepath.Join(dir, "files", abspath))
+		if err != nil {
+			os.RemoveAll(dir)
+			return Generation{}, fmt.Errorf("failed to back up %v: %w", abspath, err)
+		}
+		gen.Files = append(gen.Files, BackupFile{Path: abspath, Exists: exists})
+	}
+	b, err := json.MarshalIndent(gen, "", "  ")
+	if err != nil {
+		os.RemoveAll(dir)
+		return Generation{}, err
+	}
+	// the manifest is written last so an interrupted backup isn't listed as a generation
+	if err = ioutil.WriteFile(filepath.Join(dir, manifestName), b, 0644); err != nil {
+		os.RemoveAll(dir)
+		return Generation{}, fmt.Errorf("failed to write manifest: %w", err)
+	}
+	if _, err = s.Prune(); err != nil {
+		return gen, err
+	}
+	return gen, nil
+}
+
+// copyFile copies src to dst with the same mode, reporting false if src doesn't exist
+func copyFile(src, dst string) (bool, error) {
+	in, err := os.Open(src)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return false, err
+	}
+	if err = os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return false, err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return false, err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return false, err
+	}
+	if err = out.Sync(); err != nil {
+		out.Close()
+		return false, err
+	}
+	return true, out.Close()
+}
+
+// Generations lists the generations in the store, newest first
+func (s BackupStore) Generations() ([]Generation, error) {
+	infos, err := ioutil.ReadDir(s.Dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup directory: %w", err)
+	}
+	var gens []Generation
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(s.Dir, info.Name(), manifestName))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read manifest: %w", err)
+		}
+		var gen Generation
+		if err = json.Unmarshal(b, &gen); err != nil {
+			return nil, fmt.Errorf("malformed manifest for generation %v: %w", info.Name(), err)
+		}
+		gens = append(gens, gen)
+	}
+	sort.Slice(gens, func(i, j int) bool { return gens[i].ID > gens[j].ID })
+	return gens, nil
+}
+
+// Prune removes the generations outside of the retention policy and returns their IDs
+func (s BackupStore) Prune() ([]string, error) {
+	gens, err := s.Generations()
+	if err != nil {
+		return nil, err
+	}
+	now := s.now()
+	var pruned []string
+	for i, gen := range gens {
+		if (s.KeepLast <= 0 || i < s.KeepLast) && (s.KeepFor <= 0 || now.Sub(gen.Time) <= s.KeepFor) {
+			continue
+		}
+		if err = os.RemoveAll(filepath.Join(s.Dir, gen.ID)); err != nil {
+			return pruned, fmt.Errorf("failed to prune generation %v: %w", gen.ID, err)
+		}
+		pruned = append(pruned, gen.ID)
+	}
+	return pruned, nil
+}
+
+// Restore puts back every file of a generation, the newest when id is empty
+//
+// The files being replaced are first kept as a new generation, which is returned as backup, so a restore can be
+// undone the same way; restoring with an empty id again restores that backup. The files are swapped in the same
+// way as InstallPayload, so the returned Installation must be committed or rolled back.
+func (s BackupStore) Restore(id string) (restored, backup Generation, inst *Installation, err error) {
+	gens, err := s.Generations()
+	if err != nil {
+		return Generation{}, Generation{}, nil, err
+	}
+	var gen *Generation
+	for i := range gens {
+		if id == "" || gens[i].ID == id {
+			gen = &gens[i]
+			break
+		}
+	}
+	if gen == nil {
+		if id == "" {
+			return Generation{}, Generation{}, nil, fmt.Errorf("no generations in %v", s.Dir)
+		}
+		return Generation{}, Generation{}, nil, fmt.Errorf("no generation %v in %v", id, s.Dir)
+	}
+
+	staged := make([]string, len(gen.Files))
+	targets := make([]string, len(gen.Files))
+	removeStaged := func() {
+		for _, s := range staged {
+			if s != "" {
+				os.Remove(s)
+			}
+		}
+	}
+	for i, f := range gen.Files {
+		target, err := resolveTarget(f.Path)
+		if err != nil {
+			removeStaged()
+			return Generation{}, Generation{}, nil, err
+		}
+		targets[i] = target
+		if err = removeLeftovers(target); err != nil {
+			removeStaged()
+			return Generation{}, Generation{}, nil, err
+		}
+		if !f.Exists {
+			continue
+		}
+		kept := filepath.Join(s.Dir, gen.ID, "files", f.Path)
+		staged[i], err = stageFile(target, func(w io.Writer) error {
+			in, err := os.Open(kept)
+			if err != nil {
+				return err
+			}
+			defer in.Close()
+			_, err = io.Copy(w, in)
+			return err
+		})
+		if err != nil {
+			removeStaged()
+			return Generation{}, Generation{}, nil, fmt.Errorf("failed to stage %v: %w", f.Path, err)
+		}
+	}
+
+	paths := make([]string, len(gen.Files))
+	for i, f := range gen.Files {
+		paths[i] = f.Path
+	}
+	// staged first, since pruning after the backup may remove the generation being restored
+	if backup, err = s.Backup(paths); err != nil && backup.ID == "" {
+		removeStaged()
+		return Generation{}, Generation{}, nil, fmt.Errorf("failed to back up current files: %w", err)
+	}
+
+	if inst, err = installStaged(staged, targets); err != nil {
+		return Generation{}, backup, nil, err
+	}
+	return *gen, backup, inst, nil
+}
@@ -0,0 +1,144 @@
+package flywheel
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// clock returns the times it holds in turn
+type clock struct {
+	times []time.Time
+}
+
+func (c *clock) now() time.Time {
+	t := c.times[0]
+	if len(c.times) > 1 {
+		c.times = c.times[1:]
+	}
+	return t
+}
+
+func TestBackupStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nginx-flywheel-test-")
+	if err != nil {
+		t.Fatalf("failed to create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	main := filepath.Join(dir, "nginx", "nginx.conf")
+	include := filepath.Join(dir, "nginx", "proxy.conf")
+	if err = os.MkdirAll(filepath.Dir(main), 0755); err != nil {
+		t.Fatalf("failed to create config directory: %v", err)
+	}
+	if err = ioutil.WriteFile(main, []byte("worker_processes 1;\n"), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	start := time.Date(2020, 10, 18, 15, 4, 5, 0, time.UTC)
+	c := &clock{times: []time.Time{start, start, start.Add(time.Hour), start.Add(time.Hour), start.Add(2 * time.Hour)}}
+	store := BackupStore{Dir: filepath.Join(dir, "backups"), Now: c.now}
+	first, err := store.Backup([]string{main, include})
+	if err != nil {
+		t.Fatalf("failed to back up: %v", err)
+	}
+	if !reflect.DeepEqual(first.Files, []BackupFile{{Path: main, Exists: true}, {Path: include}}) {
+		t.Errorf("unexpected files: %+v", first.Files)
+	}
+	if err = ioutil.WriteFile(main, []byte("worker_processes 2;\n"), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	if err = ioutil.WriteFile(include, []byte("proxy_redirect off;\n"), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	second, err := store.Backup([]string{main, include})
+	if err != nil {
+		t.Fatalf("failed to back up: %v", err)
+	}
+
+	gens, err := store.Generations()
+	if err != nil {
+		t.Fatalf("failed to list generations: %v", err)
+	}
+	if len(gens) != 2 || gens[0].ID != second.ID || gens[1].ID != first.ID || first.ID != "20201018T150405.000000000Z" {
+		t.Fatalf("unexpected generations: %+v", gens)
+	}
+
+	gen, backup, inst, err := store.Restore(first.ID)
+	if err != nil {
+		t.Fatalf("failed to restore: %v", err)
+	}
+	if gen.ID != first.ID {
+		t.Errorf("restored the wrong generation: %v", gen.ID)
+	}
+	// the files the restore replaced are kept first
+	b, _ := ioutil.ReadFile(filepath.Join(store.Dir, backup.ID, "files", include))
+	if backup.ID != "20201018T170405.000000000Z" || string(b) != "proxy_redirect off;\n" {
+		t.Errorf("expected the replaced files to be backed up got %+v: %q", backup, b)
+	}
+	b, _ = ioutil.ReadFile(main)
+	if string(b) != "worker_processes 1;\n" {
+		t.Errorf("expected the first generation to be restored got: %q", b)
+	}
+	if _, err = os.Stat(include); !os.IsNotExist(err) {
+		t.Errorf("expected a file without a backup to be removed: %v", err)
+	}
+
+	if err = inst.Rollback(); err != nil {
+		t.Fatalf("failed to roll back: %v", err)
+	}
+	b, _ = ioutil.ReadFile(include)
+	if string(b) != "proxy_redirect off;\n" {
+		t.Errorf("expected the removed file to be put back got: %q", b)
+	}
+
+	if _, _, _, err = store.Restore("20000101T000000.000000000Z"); err == nil {
+		t.Errorf("expected restoring a missing generation to fail")
+	}
+}
+
+func TestBackupStorePrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nginx-flywheel-test-")
+	if err != nil {
+		t.Fatalf("failed to create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	start := time.Date(2020, 10, 18, 0, 0, 0, 0, time.UTC)
+	now := start
+	store := BackupStore{Dir: dir, Now: func() time.Time { return now }}
+	var ids []string
+	for day := 0; day < 4; day++ {
+		now = start.Add(time.Duration(day) * 24 * time.Hour)
+		gen, err := store.Backup([]string{filepath.Join(dir, "nginx.conf")})
+		if err != nil {
+			t.Fatalf("failed to back up: %v", err)
+		}
+		ids = append(ids, gen.ID)
+	}
+
+	store.KeepLast = 3
+	pruned, err := store.Prune()
+	if err != nil {
+		t.Fatalf("failed to prune: %v", err)
+	}
+	if !reflect.DeepEqual(pruned, []string{ids[0]}) {
+		t.Errorf("expected the oldest generation to be pruned: %v", pruned)
+	}
+
+	store.KeepLast = 0
+	store.KeepFor = 36 * time.Hour
+	pruned, err = store.Prune()
+	if err != nil {
+		t.Fatalf("failed to prune: %v", err)
+	}
+	if !reflect.DeepEqual(pruned, []string{ids[1]}) {
+		t.Errorf("expected generations older than KeepFor to be pruned: %v", pruned)
+	}
+	gens, err := store.Generations()
+	if err != nil || len(gens) != 2 {
+		t.Errorf("expected 2 generations left: %+v %v", gens, err)
+	}
+}
@@ -0,0 +1,138 @@
+package flywheel
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// MergePolicy decides how a Chain combines the operations of its providers
+type MergePolicy string
+
+const (
+	// MergeFirst uses the operation of the first provider that has one
+	MergeFirst MergePolicy = "first"
+	// MergeAppend combines the operations of every provider that has one, in order
+	//
+	// Replace args, inserted directives and arg sets are appended; every provider must agree on the OpType.
+	MergeAppend MergePolicy = "append"
+)
+
+// Chain is a OverrideProvider that consults several providers in order of precedence
+//
+// For example env > local file > etcd-region > etcd-global lets each provider hold exceptions to the next.
+type Chain struct {
+	_ struct{}
+	// Providers are consulted first to last
+	Providers []OverrideProvider
+	// Policy is MergeFirst when empty
+	Policy MergePolicy
+}
+
+var _ OverrideProvider = (*Chain)(nil)
+var _ Prefetcher = (*Chain)(nil)
+var _ Versioned = (*Chain)(nil)
+var _ KeyResolver = (*Chain)(nil)
+var _ RelativeResolver = (*Chain)(nil)
+
+// Override satisfies the OverrideProvider interface
+func (c *Chain) Override(ctx context.Context, ref DirectiveRef) (Operation, error) {
+	var merged Operation
+	for i, p := range c.Providers {
+		op, err := p.Override(ctx, ref)
+		if err != nil {
+			return Operation{}, fmt.Errorf("provider %v: %w", i, err)
+		}
+		if op.Op == OpNone {
+			continue
+		}
+
+		switch c.Policy {
+		case MergeFirst, "":
+			return op, nil
+		case MergeAppend:
+			if merged.Op == OpNone {
+				merged = Operation{Op: op.Op}
+			} else if merged.Op != op.Op {
+				return Operation{}, fmt.Errorf("provider %v: can't append %v operation to %v operation for %v", i, op.Op, merged.Op, ref.BlockPath())
+			}
+			if op.Op == OpReplace {
+				merged.Args = append(append([]string{}, merged.Args...), op.Args...)
+			}
+			merged.Directives = append(merged.Directives, op.Directives...)
+			merged.ArgSets = append(merged.ArgSets, op.ArgSets...)
+		default:
+			return Operation{}, fmt.Errorf("unknown merge policy: %q", c.Policy)
+		}
+	}
+	return merged, nil
+}
+
+// Prefetch satisfies the Prefetcher interface for every provider that supports it
+func (c *Chain) Prefetch(ctx context.Context, paths []string) error {
+	for i, p := range c.Providers {
+		if pf, ok := p.(Prefetcher); ok {
+			if err := pf.Prefetch(ctx, paths); err != nil {
+				return fmt.Errorf("provider %v: %w", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Version satisfies the Versioned interface by joining the versions of every provider that has one
+func (c *Chain) Version() string {
+	var versions []string
+	for _, p := range c.Providers {
+		if v, ok := p.(Versioned); ok && v.Version() != "" {
+			versions = append(versions, v.Version())
+		}
+	}
+	return strings.Join(versions, ", ")
+}
+
+// Resolve satisfies the KeyResolver interface; the first provider with the key wins regardless of Policy
+//
+// Providers that can't resolve keys are skipped.
+func (c *Chain) Resolve(ctx context.Context, key string) (Operation, bool, error) {
+	for i, p := range c.Providers {
+		r, ok := p.(KeyResolver)
+		if !ok {
+			continue
+		}
+		op, ok, err := r.Resolve(ctx, key)
+		if err != nil {
+			return Operation{}, false, fmt.Errorf("provider %v: %w", i, err)
+		}
+		if ok {
+			return op, true, nil
+		}
+	}
+	return Operation{}, false, nil
+}
+
+// BaseKey satisfies the RelativeResolver interface with the base key of the first provider that has one
+func (c *Chain) BaseKey(ref DirectiveRef) string {
+	for _, p := range c.Providers {
+		if r, ok := p.(RelativeResolver); ok {
+			if base := r.BaseKey(ref); base != "" {
+				return base
+			}
+		}
+	}
+	return ""
+}
+
+// Close closes every provider, even if some fail
+func (c *Chain) Close() error {
+	var errs []string
+	for i, p := range c.Providers {
+		if err := p.Close(); err != nil {
+			errs = append(errs, fmt.Sprintf("provider %v: %v", i, err))
+		}
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf("failed to close providers: %v", strings.Join(errs, "; "))
+	}
+	return nil
+}
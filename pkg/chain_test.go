@@ -0,0 +1,101 @@
+package flywheel
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/aluttik/go-crossplane"
+)
+
+// closeProvider wraps opProvider and records Close
+type closeProvider struct {
+	opProvider
+	closed bool
+	err    error
+}
+
+func (c *closeProvider) Close() error {
+	c.closed = true
+	return c.err
+}
+
+func TestChain(t *testing.T) {
+	env := opProvider{"http/listen": Replace("8080"), "http/server": ReplaceAll([]string{"a:80"})}
+	file := opProvider{"http/listen": Replace("80"), "http/server_name": Replace("a.com"), "http/gzip": {Op: OpDelete}}
+	etcd := opProvider{"http/server_name": Replace("b.com"), "http/root": Replace("html"), "http/server": ReplaceAll([]string{"b:80"})}
+
+	tests := []struct {
+		policy    MergePolicy
+		directive string
+		expected  Operation
+		err       bool
+	}{
+		{policy: MergeFirst, directive: "listen", expected: Replace("8080")},
+		{policy: MergeFirst, directive: "server_name", expected: Replace("a.com")},
+		{policy: "", directive: "root", expected: Replace("html")},
+		{policy: MergeFirst, directive: "user"},
+		{policy: MergeAppend, directive: "server_name", expected: Replace("a.com", "b.com")},
+		{policy: MergeAppend, directive: "gzip", expected: Operation{Op: OpDelete}},
+		{policy: MergeAppend, directive: "server", expected: ReplaceAll([]string{"a:80"}, []string{"b:80"})},
+		{policy: MergeAppend, directive: "user"},
+		{policy: "last", directive: "listen", err: true},
+	}
+	for _, test := range tests {
+		c := &Chain{Providers: []OverrideProvider{env, file, etcd}, Policy: test.policy}
+		op, err := c.Override(context.Background(), DirectiveRef{Directive: test.directive, Blocks: []string{"http"}})
+		if test.err {
+			if err == nil {
+				t.Errorf("expected error for policy %v", test.policy)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %v: %v", test.directive, err)
+			continue
+		}
+		if !reflect.DeepEqual(op, test.expected) {
+			t.Errorf("%v %v: expected '%+v' got '%+v'", test.policy, test.directive, test.expected, op)
+		}
+	}
+}
+
+func TestChainAppendConflict(t *testing.T) {
+	c := &Chain{Policy: MergeAppend, Providers: []OverrideProvider{
+		opProvider{"gzip": Replace("on")},
+		opProvider{"gzip": {Op: OpInsert, Directives: []crossplane.Directive{{Directive: "gzip_types"}}}},
+	}}
+	if _, err := c.Override(context.Background(), DirectiveRef{Directive: "gzip"}); err == nil {
+		t.Errorf("expected conflicting operations to fail")
+	}
+}
+
+func TestChainResolve(t *testing.T) {
+	c := &Chain{Providers: []OverrideProvider{
+		opProvider{},
+		resolverProvider{"/port": Replace("8080")},
+		resolverProvider{"/port": Replace("80"), "/host": Replace("a.com")},
+	}}
+	for key, expected := range map[string]Operation{"/port": Replace("8080"), "/host": Replace("a.com")} {
+		op, ok, err := c.Resolve(context.Background(), key)
+		if err != nil || !ok || !reflect.DeepEqual(op, expected) {
+			t.Errorf("%v: expected '%+v' got '%+v' %v %v", key, expected, op, ok, err)
+		}
+	}
+	if _, ok, err := c.Resolve(context.Background(), "/missing"); ok || err != nil {
+		t.Errorf("expected a missing key: %v %v", ok, err)
+	}
+}
+
+func TestChainClose(t *testing.T) {
+	first := &closeProvider{err: errors.New("boom")}
+	second := &closeProvider{}
+	c := &Chain{Providers: []OverrideProvider{first, second}}
+	if err := c.Close(); err == nil {
+		t.Errorf("expected close error")
+	}
+	if !first.closed || !second.closed {
+		t.Errorf("expected every provider to be closed")
+	}
+}
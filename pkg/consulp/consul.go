@@ -0,0 +1,153 @@
+package consulp
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Brian-Williams/nginx_flywheel/pkg"
+)
+
+// ConsulProvider is a OverrideProvider for Consul's KV HTTP API
+//
+// Keys are produced the same way as etcdp.Etcd3Provider, then placed under Prefix.
+type ConsulProvider struct {
+	_ struct{}
+	// Address of the Consul agent, e.g. http://127.0.0.1:8500
+	Address string
+	// Token is the ACL token sent with every request, if any
+	Token string
+	// Prefix is the KV path that all keys are nested under, e.g. nginx-flywheel
+	Prefix string
+	// LStrip is the prefix strip for NGINX config location
+	LStrip string
+	// Client makes the requests; http.DefaultClient is used when nil
+	Client *http.Client
+}
+
+var _ flywheel.KeyedProvider = (*ConsulProvider)(nil)
+var _ flywheel.KeyResolver = (*ConsulProvider)(nil)
+var _ flywheel.RelativeResolver = (*ConsulProvider)(nil)
+
+// Override satisfies the OverrideProvider interface
+//
+// The first of Keys with a value wins. Values are decoded with flywheel.DecodeOperation.
+func (c *ConsulProvider) Override(ctx context.Context, ref flywheel.DirectiveRef) (flywheel.Operation, error) {
+	for _, key := range c.Keys(ref) {
+		value, ok, err := c.Get(ctx, key)
+		if err != nil {
+			return flywheel.Operation{}, err
+		}
+		if !ok {
+			continue
+		}
+		op, err := flywheel.DecodeOperation(value)
+		if err != nil {
+			return flywheel.Operation{}, fmt.Errorf("invalid value for key %v: %w", key, err)
+		}
+		return op, nil
+	}
+	return flywheel.Operation{}, nil
+}
+
+// Close satisfies the OverrideProvider interface
+func (c *ConsulProvider) Close() error {
+	c.client().CloseIdleConnections()
+	return nil
+}
+
+// Keys produces the Consul keys that are looked up for a directive, most specific first
+func (c *ConsulProvider) Keys(ref flywheel.DirectiveRef) []string {
+	keys := flywheel.KeyScheme{LStrip: c.LStrip}.Keys(ref)
+	for i, key := range keys {
+		keys[i] = c.Key(key)
+	}
+	return keys
+}
+
+// BaseKey satisfies the RelativeResolver interface with the flywheel key, which Resolve places under Prefix
+func (c *ConsulProvider) BaseKey(ref flywheel.DirectiveRef) string {
+	return flywheel.KeyScheme{LStrip: c.LStrip}.BaseKey(ref)
+}
+
+// Key places a flywheel key under Prefix, which satisfies the KeyedProvider interface
+//
+// Consul keys don't start with a slash, so /nginx/listen with Prefix nginx-flywheel produces
+// nginx-flywheel/nginx/listen.
+func (c *ConsulProvider) Key(key string) string {
+	prefix := strings.Trim(c.Prefix, "/")
+	key = strings.TrimPrefix(key, "/")
+	if prefix == "" {
+		return key
+	}
+	return prefix + "/" + key
+}
+
+// Lookup satisfies the KeyedProvider interface
+func (c *ConsulProvider) Lookup(ctx context.Context, key string) ([]byte, bool, error) {
+	return c.Get(ctx, key)
+}
+
+// Resolve satisfies the KeyResolver interface; the key is placed under Prefix
+func (c *ConsulProvider) Resolve(ctx context.Context, key string) (flywheel.Operation, bool, error) {
+	key = c.Key(key)
+	value, ok, err := c.Get(ctx, key)
+	if err != nil || !ok {
+		return flywheel.Operation{}, false, err
+	}
+	op, err := flywheel.DecodeOperation(value)
+	if err != nil {
+		return flywheel.Operation{}, false, fmt.Errorf("invalid value for key %v: %w", key, err)
+	}
+	return op, true, nil
+}
+
+// Get reads the raw value of a Consul key; false is returned when the key doesn't exist
+func (c *ConsulProvider) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	req, err := http.NewRequest(http.MethodGet, c.kvURL(key)+"?raw", nil)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to create request: %w", err)
+	}
+	req = req.WithContext(ctx)
+	if c.Token != "" {
+		req.Header.Set("X-Consul-Token", c.Token)
+	}
+
+	resp, err := c.client().Do(req)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get key %v: %w", key, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read key %v: %w", key, err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return body, true, nil
+	case http.StatusNotFound:
+		return nil, false, nil
+	default:
+		return nil, false, fmt.Errorf("failed to get key %v: %v: %v", key, resp.Status, strings.TrimSpace(string(body)))
+	}
+}
+
+// kvURL escapes each segment of the key, as block names may contain spaces and regular expressions
+func (c *ConsulProvider) kvURL(key string) string {
+	segments := strings.Split(key, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.TrimSuffix(c.Address, "/") + "/v1/kv/" + strings.Join(segments, "/")
+}
+
+func (c *ConsulProvider) client() *http.Client {
+	if c.Client == nil {
+		return http.DefaultClient
+	}
+	return c.Client
+}
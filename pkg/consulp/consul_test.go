@@ -0,0 +1,84 @@
+package consulp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Brian-Williams/nginx_flywheel/pkg"
+)
+
+// fakeConsul serves raw KV values and enforces an ACL token
+func fakeConsul(t *testing.T, token string, kv map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Consul-Token") != token {
+			http.Error(w, "Permission denied", http.StatusForbidden)
+			return
+		}
+		if _, ok := r.URL.Query()["raw"]; !ok {
+			t.Errorf("expected raw query: %v", r.URL)
+		}
+		value, ok := kv[strings.TrimPrefix(r.URL.Path, "/v1/kv/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(value))
+	}))
+}
+
+func TestOverride(t *testing.T) {
+	server := fakeConsul(t, "secret", map[string]string{
+		"flywheel/nginx/listen": "8080",
+		"flywheel/nginx/http/server[domain1.com 443]/location[/]/proxy_pass": "http://127.0.0.1:9000",
+		"flywheel/nginx/sendfile": `{"op": "delete"}`,
+	})
+	defer server.Close()
+	c := &ConsulProvider{Address: server.URL, Token: "secret", Prefix: "/flywheel/", LStrip: "/etc/nginx"}
+	defer c.Close()
+
+	tests := []struct {
+		ref      flywheel.DirectiveRef
+		expected flywheel.Operation
+	}{
+		{
+			ref:      flywheel.DirectiveRef{Directive: "listen", Path: "/etc/nginx/nginx.conf", Blocks: []string{"http", "server[domain1.com 443]"}},
+			expected: flywheel.Replace("8080"),
+		},
+		{
+			ref:      flywheel.DirectiveRef{Directive: "proxy_pass", Path: "/etc/nginx/nginx.conf", Blocks: []string{"http", "server[domain1.com 443]", "location[/]"}},
+			expected: flywheel.Replace("http://127.0.0.1:9000"),
+		},
+		{
+			ref:      flywheel.DirectiveRef{Directive: "sendfile", Path: "/etc/nginx/nginx.conf", Blocks: []string{"http"}},
+			expected: flywheel.Operation{Op: flywheel.OpDelete},
+		},
+		{
+			ref: flywheel.DirectiveRef{Directive: "user", Path: "/etc/nginx/nginx.conf"},
+		},
+	}
+	for _, test := range tests {
+		op, err := c.Override(context.Background(), test.ref)
+		if err != nil {
+			t.Errorf("failed to override %v: %v", test.ref.BlockPath(), err)
+			continue
+		}
+		if !reflect.DeepEqual(op, test.expected) {
+			t.Errorf("expected '%+v' got '%+v'", test.expected, op)
+		}
+	}
+}
+
+func TestOverrideToken(t *testing.T) {
+	server := fakeConsul(t, "secret", nil)
+	defer server.Close()
+	c := &ConsulProvider{Address: server.URL, Token: "wrong"}
+
+	_, err := c.Override(context.Background(), flywheel.DirectiveRef{Directive: "listen", Path: "/etc/nginx/nginx.conf"})
+	if err == nil || !strings.Contains(err.Error(), "Permission denied") {
+		t.Errorf("expected permission denied got: %v", err)
+	}
+}
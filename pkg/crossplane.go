@@ -3,20 +3,80 @@ package flywheel
 import (
 	"bufio"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/aluttik/go-crossplane"
 )
 
-// OverrideProvider produces nginx args for a given directive
+// OverrideProvider produces the Operation to apply to a given directive
 type OverrideProvider interface {
-	Override(ctx context.Context, directive string, path string) ([]string, error)
+	Override(ctx context.Context, ref DirectiveRef) (Operation, error)
 	Close() error
 }
 
+// Prefetcher is an OverrideProvider that can load everything it needs for a payload up front
+//
+// OverridePayload calls Prefetch with the files of the payload before overriding any directive.
+type Prefetcher interface {
+	Prefetch(ctx context.Context, paths []string) error
+}
+
+// DirectiveRef locates a directive within a parsed NGINX config
+type DirectiveRef struct {
+	// Directive is the name of the directive
+	Directive string
+	// Path is the absolute path of the file containing the directive
+	Path string
+	// Blocks are the names of the enclosing blocks, outermost first
+	//
+	// See BlockName for how a block is named.
+	Blocks []string
+}
+
+// BlockPath joins the enclosing blocks and the directive
+//
+// For example proxy_pass inside `location /` of the domain1.com server would produce
+// http/server[domain1.com 443]/location[/]/proxy_pass
+func (r DirectiveRef) BlockPath() string {
+	return strings.Join(append(r.Blocks[:len(r.Blocks):len(r.Blocks)], r.Directive), "/")
+}
+
+// BlockName produces the name a block directive contributes to a DirectiveRef
+//
+// Block args are joined with spaces inside brackets, e.g. `location[~ \.php$]`. A `server` block has no args
+// so it's named by the first server_name in it and the address of its first listen instead, e.g.
+// `server[domain1.com 443]`, which tells apart the servers of a name that listen on different ports, such as a port 80
+// redirect. Either is left out when the server doesn't have one.
+func BlockName(d crossplane.Directive) string {
+	args := d.Args
+	if d.Directive == "server" && len(args) == 0 && d.Block != nil {
+		var name, listen string
+		for _, c := range *d.Block {
+			switch {
+			case c.Directive == "server_name" && len(c.Args) > 0 && name == "":
+				name = c.Args[0]
+			case c.Directive == "listen" && len(c.Args) > 0 && listen == "":
+				listen = c.Args[0]
+			}
+		}
+		args = nil
+		for _, arg := range []string{name, listen} {
+			if arg != "" {
+				args = append(args, arg)
+			}
+		}
+	}
+	if len(args) == 0 {
+		return d.Directive
+	}
+	return d.Directive + "[" + strings.Join(args, " ") + "]"
+}
+
 // UpdatedFile is a file with a reference to it's original location
 type UpdatedFile struct {
 	*os.File
@@ -28,31 +88,77 @@ func (f UpdatedFile) Rename() error {
 	return os.Rename(f.File.Name(), f.OGName)
 }
 
-// WritePayload writes a payload to a file
+// WritePayload writes each config of a payload to its file
+//
+// The files are replaced with InstallPayload, so a failure part way leaves the previous files in place.
 func WritePayload(p *crossplane.Payload, options *crossplane.BuildOptions) error {
-	for _, c := range p.Config {
-		err := writeConfig(c.File, c, options)
-		if err != nil {
-			return fmt.Errorf("failed to handle config: %w", err)
-		}
+	inst, err := InstallPayload(p, options)
+	if err != nil {
+		return fmt.Errorf("failed to handle config: %w", err)
 	}
+	return inst.Commit()
+}
 
+// RelocatePayload moves every config of the payload under dir, mirroring the include tree
+//
+// Paths are kept relative to the directory of the main config, which is the first config of the payload. A file
+// outside of that directory is placed under dir by its absolute path instead.
+func RelocatePayload(p *crossplane.Payload, dir string) error {
+	files, err := relocatedFiles(p, dir)
+	if err != nil {
+		return err
+	}
+	for i := range p.Config {
+		p.Config[i].File = files[i]
+	}
 	return nil
 }
 
+// relocatedFiles are the paths of the configs of the payload when it's relocated under dir
+func relocatedFiles(p *crossplane.Payload, dir string) ([]string, error) {
+	if len(p.Config) == 0 {
+		return nil, nil
+	}
+	root, err := filepath.Abs(filepath.Dir(p.Config[0].File))
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve main config directory: %w", err)
+	}
+	files := make([]string, len(p.Config))
+	for i, c := range p.Config {
+		abspath, err := filepath.Abs(c.File)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve config path: %w", err)
+		}
+		rel, err := filepath.Rel(root, abspath)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			rel = abspath
+		}
+		files[i] = filepath.Join(dir, rel)
+	}
+	return files, nil
+}
+
 // WritePayloadTmp writes the output to a tempdir and returns the files
 //
-// A caller may want to remove the files or `Rename()` them to their intended location.
+// The include tree is mirrored in the tempdir the same way as RelocatePayload, so relative includes resolve against
+// the staged main config. A caller may want to remove the files or `Rename()` them to their intended location.
 func WritePayloadTmp(p *crossplane.Payload, options *crossplane.BuildOptions) ([]UpdatedFile, error) {
 	tmpDir, err := ioutil.TempDir("", "nginx-flywheel-")
 	if err != nil {
 		return nil, fmt.Errorf("failed to create tmpdir: %w", err)
 	}
+	files, err := relocatedFiles(p, tmpDir)
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return nil, err
+	}
 
 	tmpFiles := make([]UpdatedFile, len(p.Config))
 	for i, c := range p.Config {
-		// Force flat structure; files can be given correct structure with `Rename`
-		f, err := os.Create(filepath.Join(tmpDir, filepath.Base(c.File)))
+		if err = os.MkdirAll(filepath.Dir(files[i]), 0755); err != nil {
+			return tmpFiles, fmt.Errorf("failed to create directory: %w", err)
+		}
+		f, err := os.Create(files[i])
 		if err != nil {
 			return tmpFiles, fmt.Errorf("failed to create file: %w", err)
 		}
@@ -74,6 +180,9 @@ func WritePayloadTmp(p *crossplane.Payload, options *crossplane.BuildOptions) ([
 // This uses a string instead of a file descriptor to match parse, which handles fd as it's what's
 // searching for the NGINX conf files.
 func writeConfig(f string, c crossplane.Config, options *crossplane.BuildOptions) error {
+	if err := os.MkdirAll(filepath.Dir(f), 0755); err != nil {
+		return fmt.Errorf("failed to create NGINX config directory: %w", err)
+	}
 	fd, err := os.Create(f)
 	if err != nil {
 		return fmt.Errorf("failed to create NGINX config file: %w", err)
@@ -94,52 +203,283 @@ func writeConfig(f string, c crossplane.Config, options *crossplane.BuildOptions
 	return nil
 }
 
+// CopyPayload deep copies a payload so it can be overridden without modifying the original
+func CopyPayload(p *crossplane.Payload) (*crossplane.Payload, error) {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal payload: %w", err)
+	}
+	var c crossplane.Payload
+	if err = json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal payload: %w", err)
+	}
+	return &c, nil
+}
+
+// WalkPayload calls fn for every directive of the payload that isn't a comment, parents before their blocks
+func WalkPayload(p *crossplane.Payload, fn func(ref DirectiveRef, d *crossplane.Directive) error) error {
+	for i := range p.Config {
+		c := &p.Config[i]
+		if err := walkDirectives(c.Parsed, c.File, nil, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func walkDirectives(ds []crossplane.Directive, abspath string, blocks []string, fn func(ref DirectiveRef, d *crossplane.Directive) error) error {
+	for i := range ds {
+		d := &ds[i]
+		if d.IsComment() {
+			continue
+		}
+		if err := fn(DirectiveRef{Directive: d.Directive, Path: abspath, Blocks: blocks}, d); err != nil {
+			return err
+		}
+		if d.Block != nil {
+			err := walkDirectives(*d.Block, abspath, append(blocks[:len(blocks):len(blocks)], BlockName(*d)), fn)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// OverrideOptions change how OverridePayload handles the payload
+type OverrideOptions struct {
+	// CollectErrors keeps going after a directive fails to override and returns every failure as OverrideErrors
+	//
+	// A directive that fails is left unchanged, including its block.
+	CollectErrors bool
+	// Templates resolves template expressions within args, e.g. `{{ key "/upstreams/api/port" }}`; see RenderArg
+	//
+	// The provider must be a KeyResolver, and a RelativeResolver for bare names such as `{{host}}`. Only args written in the source config are rendered; args that come from
+	// the provider are used as is.
+	Templates bool
+	// Strict fails with a *MissingKeysError listing every directive annotated `# flywheel:required` that no provider
+	// overrode; a template in its args that resolves counts as an override, a `# flywheel:default` doesn't
+	Strict bool
+}
+
 // OverridePayload overrides each config in the payload
-func OverridePayload(ctx context.Context, p *crossplane.Payload, o OverrideProvider) error {
+//
+// The first directive that fails to override stops the run with a *DirectiveError, unless options collect them.
+// options may be nil for the defaults.
+func OverridePayload(ctx context.Context, p *crossplane.Payload, o OverrideProvider, options *OverrideOptions) error {
+	if options == nil {
+		options = &OverrideOptions{}
+	}
+	ov := &overrider{o: o, options: *options}
+	if options.Templates {
+		r, ok := o.(KeyResolver)
+		if !ok {
+			return fmt.Errorf("provider %T can't resolve template expressions", o)
+		}
+		ov.resolver = r
+	}
+	if pf, ok := o.(Prefetcher); ok {
+		paths := make([]string, len(p.Config))
+		for i, c := range p.Config {
+			paths[i] = c.File
+		}
+		if err := pf.Prefetch(ctx, paths); err != nil {
+			return fmt.Errorf("failed to prefetch overrides: %w", err)
+		}
+	}
 	for i := range p.Config {
-		config := p.Config[i]
-		err := overrideDirectives(ctx, &config.Parsed, o, config.File)
+		config := &p.Config[i]
+		err := ov.overrideDirectives(ctx, &config.Parsed, config.File, nil, 0)
 		if err != nil {
 			return err
 		}
 	}
+	if len(ov.errs) != 0 {
+		return ov.errs
+	}
+	if len(ov.missing) != 0 {
+		return newMissingKeysError(ov.missing)
+	}
 	return nil
 }
 
-func overrideDirectives(ctx context.Context, ds *[]crossplane.Directive, o OverrideProvider, abspath string) error {
+// overrider is the state of overriding a payload
+type overrider struct {
+	o       OverrideProvider
+	options OverrideOptions
+	// resolver resolves template expressions when options.Templates is set
+	resolver KeyResolver
+	// errs are the failures collected when options.CollectErrors is set
+	errs OverrideErrors
+	// missing are the required directives that weren't overridden when options.Strict is set
+	missing []*DirectiveError
+}
+
+// overrideDirectives applies the provider's operations to a list of directives
+//
+// Deleted directives are dropped and inserted directives are added after the directive they were returned for.
+// A group replaced by OpReplaceAll takes the place of its first directive and the rest of the group is dropped
+// without consulting the provider. Inserted and replacement directives aren't overridden themselves.
+//
+// Unless errors are collected the first failure is returned; a collected failure keeps the directive as is.
+// parentLine is the line of the block directive enclosing ds, or 0, so annotations can be attached.
+func (ov *overrider) overrideDirectives(ctx context.Context, ds *[]crossplane.Directive, abspath string, blocks []string, parentLine int) error {
 	if ds == nil {
 		return fmt.Errorf("directive list is nil for: %v", abspath)
 	}
 	dsValues := *ds
+	overridden := make([]crossplane.Directive, 0, len(dsValues))
+	replacedGroups := make(map[string]bool)
 	for i := range dsValues {
-		err := overrideDirective(ctx, &dsValues[i], o, abspath)
+		if !dsValues[i].IsComment() && replacedGroups[dsValues[i].Directive] {
+			continue
+		}
+		var a annotations
+		var err error
+		if !dsValues[i].IsComment() {
+			if a, err = directiveAnnotations(dsValues, i, parentLine); err != nil {
+				err = newDirectiveError(&dsValues[i], abspath, blocks, err)
+			}
+		}
+		var op Operation
+		if err == nil {
+			op, err = ov.overrideDirective(ctx, &dsValues[i], abspath, blocks, a)
+		}
 		if err != nil {
-			return err
+			dErr, ok := err.(*DirectiveError)
+			if !ov.options.CollectErrors || !ok {
+				return err
+			}
+			ov.errs = append(ov.errs, dErr)
+			overridden = append(overridden, dsValues[i])
+			continue
+		}
+		switch op.Op {
+		case OpDelete:
+		case OpInsert:
+			overridden = append(overridden, dsValues[i])
+			overridden = append(overridden, op.Directives...)
+		case OpReplaceAll:
+			replacedGroups[dsValues[i].Directive] = true
+			for _, args := range op.ArgSets {
+				d := dsValues[i]
+				d.Args = args
+				overridden = append(overridden, d)
+			}
+		default:
+			overridden = append(overridden, dsValues[i])
 		}
 	}
+	*ds = overridden
 	return nil
 }
 
+// override looks up the operation for a directive, from its custom key if it's annotated with one
+func (ov *overrider) override(ctx context.Context, ref DirectiveRef, a annotations) (Operation, error) {
+	if a.key == "" {
+		return ov.o.Override(ctx, ref)
+	}
+	r, ok := ov.o.(KeyResolver)
+	if !ok {
+		return Operation{}, fmt.Errorf("provider can't look up custom key %q", a.key)
+	}
+	op, ok, err := r.Resolve(ctx, a.key)
+	if err != nil || !ok {
+		return Operation{}, err
+	}
+	return op, nil
+}
+
+// requireOverride records d as missing in a strict run when it's annotated required and wasn't overridden
+func (ov *overrider) requireOverride(d *crossplane.Directive, ref DirectiveRef, a annotations, overridden bool) {
+	if !ov.options.Strict || !a.required || overridden {
+		return
+	}
+	err := &requiredError{keys: requiredKeys(ov.o, ref, a)}
+	ov.missing = append(ov.missing, newDirectiveError(d, ref.Path, ref.Blocks, err))
+}
+
 // overrideDirective overrides a single directives args
-func overrideDirective(ctx context.Context, d *crossplane.Directive, o OverrideProvider, abspath string) error {
+//
+// blocks are the names of the blocks enclosing the directive, outermost first. The operation is returned so the
+// caller can handle deletes, inserts and replacing groups, which change the enclosing list. Failures are returned as
+// a *DirectiveError.
+//
+// a are the annotations attached to the directive: a skipped directive is left as is, a custom key is resolved in
+// place of the provider's own keys, and a default applies when nothing overrides the directive.
+func (ov *overrider) overrideDirective(ctx context.Context, d *crossplane.Directive, abspath string, blocks []string, a annotations) (Operation, error) {
 	if d == nil {
-		return fmt.Errorf("directive is nil for: %v", abspath)
+		return Operation{}, fmt.Errorf("directive is nil for: %v", abspath)
 	}
 	if d.IsComment() {
-		return nil
+		return Operation{}, nil
+	}
+	if a.skip {
+		return Operation{}, nil
 	}
-	args, err := o.Override(ctx, d.Directive, abspath)
+	ref := DirectiveRef{Directive: d.Directive, Path: abspath, Blocks: blocks}
+	// the block keeps the name of its source args, which ExportKeys and CurrentValues list its children under
+	name := BlockName(*d)
+	op, err := ov.override(ctx, ref, a)
 	if err != nil {
-		return err
+		return Operation{}, newDirectiveError(d, abspath, blocks, err)
+	}
+	if err = op.Validate(); err != nil {
+		return Operation{}, newDirectiveError(d, abspath, blocks, fmt.Errorf("invalid operation: %w", err))
+	}
+	provided := op.Op != OpNone
+	// only args written in the source config, including a default annotation, are templates; a provider's values are
+	// used as is so they can't contain expressions or read other keys
+	render := ov.resolver != nil && (op.Op == OpNone || op.Op == OpInsert)
+	base := ""
+	if r, ok := ov.resolver.(RelativeResolver); ok && render {
+		base = r.BaseKey(ref)
 	}
-	if len(args) != 0 {
-		d.Args = args
+	defaulted := false
+	if op.Op == OpNone && a.defaultOp != nil {
+		op = *a.defaultOp
+		defaulted = true
 	}
+	switch op.Op {
+	case OpDelete:
+		ov.requireOverride(d, ref, a, provided)
+		return op, nil
+	case OpReplace:
+		d.Args = op.Args
+	case OpReplaceAll:
+		if d.IsBlock() {
+			return Operation{}, newDirectiveError(d, abspath, blocks, fmt.Errorf("%v can't replace block directives", op.Op))
+		}
+		if render {
+			argSets := make([][]string, len(op.ArgSets))
+			for i, args := range op.ArgSets {
+				if argSets[i], err = RenderArgs(ctx, args, ov.resolver, base); err != nil {
+					return Operation{}, newDirectiveError(d, abspath, blocks, err)
+				}
+			}
+			op.ArgSets = argSets
+		}
+		ov.requireOverride(d, ref, a, provided)
+		return op, nil
+	}
+	templated := false
+	if render {
+		// a template in the source args that resolves fills the directive in as much as the provider would
+		templated = !defaulted && hasTemplate(d.Args)
+		if d.Args, err = RenderArgs(ctx, d.Args, ov.resolver, base); err != nil {
+			return Operation{}, newDirectiveError(d, abspath, blocks, err)
+		}
+	}
+	ov.requireOverride(d, ref, a, provided || templated)
 	if d.IsBlock() {
 		if d.Block != nil {
-			overrideDirectives(ctx, d.Block, o, abspath)
+			// full slice expression so siblings never share a backing array
+			err = ov.overrideDirectives(ctx, d.Block, abspath, append(blocks[:len(blocks):len(blocks)], name), d.Line)
+			if err != nil {
+				return Operation{}, err
+			}
 		}
 	}
 
-	return nil
+	return op, nil
 }
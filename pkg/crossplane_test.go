@@ -3,6 +3,7 @@ package flywheel
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"path/filepath"
 	"reflect"
 	"strings"
@@ -16,8 +17,8 @@ var parsedExample = `{"status":"ok","errors":[],"config":[{"file":"../../test/ng
 
 type dummyProvider struct{}
 
-func (d dummyProvider) Override(_ context.Context, directive, path string) ([]string, error) {
-	return []string{"dummy" + directive}, nil
+func (d dummyProvider) Override(_ context.Context, ref DirectiveRef) (Operation, error) {
+	return Replace("dummy" + ref.Directive), nil
 }
 
 func (d dummyProvider) Close() error {
@@ -29,7 +30,7 @@ func TestWritePayloadTmp(t *testing.T) {
 	if err := json.Unmarshal([]byte(parsedExample), &payload); err != nil {
 		t.Fatalf("failed to unmarshal test data: %v", err)
 	}
-	err := OverridePayload(context.Background(), &payload, dummyProvider{})
+	err := OverridePayload(context.Background(), &payload, dummyProvider{}, nil)
 	if err != nil {
 		t.Fatalf("failed to override payload: %v", err)
 	}
@@ -47,7 +48,7 @@ func TestWritePayloadTmp(t *testing.T) {
 		}
 	}
 
-	// don't follow includes as we flatten the structure in WritePayloadTmp
+	// don't follow includes as the dummy args replaced their paths
 	testPayload, err := crossplane.Parse(baseConfig, &crossplane.ParseOptions{
 		SingleFile:             true,
 		SkipDirectiveArgsCheck: true,
@@ -79,9 +80,328 @@ func TestOverrideDirective(t *testing.T) {
 		Line:      1,
 		Args:      []string{"hi", "mom"},
 	}
-	overrideDirective(context.Background(), &directive, dummyProvider{}, "")
+	(&overrider{o: dummyProvider{}}).overrideDirective(context.Background(), &directive, "", nil, annotations{})
 
 	if !reflect.DeepEqual(directive.Args, []string{"dummyfoo"}) {
 		t.Errorf("failed to modify args")
 	}
 }
+
+// blockPathProvider records the block path of every directive it's asked about
+type blockPathProvider struct {
+	paths []string
+}
+
+func (b *blockPathProvider) Override(_ context.Context, ref DirectiveRef) (Operation, error) {
+	b.paths = append(b.paths, ref.BlockPath())
+	return Operation{}, nil
+}
+
+func (b *blockPathProvider) Close() error {
+	return nil
+}
+
+func TestOverridePayloadBlockPath(t *testing.T) {
+	var payload crossplane.Payload
+	if err := json.Unmarshal([]byte(parsedExample), &payload); err != nil {
+		t.Fatalf("failed to unmarshal test data: %v", err)
+	}
+	o := &blockPathProvider{}
+	err := OverridePayload(context.Background(), &payload, o, nil)
+	if err != nil {
+		t.Fatalf("failed to override payload: %v", err)
+	}
+
+	for _, expected := range []string{
+		"user",
+		"events/worker_connections",
+		"http/server[domain1.com 80]/location[~ \\.php$]/fastcgi_pass",
+		"http/server[domain2.com 80]/location[/]/proxy_pass",
+		"http/upstream[big_server_com]/server",
+		"http/server[big.server.com 80]/location[/]/proxy_pass",
+		"types/text/html",
+	} {
+		found := false
+		for _, p := range o.paths {
+			if p == expected {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("expected block path '%v' in %v", expected, o.paths)
+		}
+	}
+}
+
+func TestOverridePayloadServerNames(t *testing.T) {
+	payload := parseAnnotated(t, `http {
+    server {
+        listen 80;
+        server_name example.com;
+        return 301 https://$host$request_uri;
+    }
+    server {
+        listen 443 ssl;
+        server_name example.com;
+        location / {
+            proxy_pass http://127.0.0.1:8080;
+        }
+    }
+}
+`)
+	k := KeyScheme{LStrip: filepath.Dir(payload.Config[0].File)}
+	values, duplicates, err := CurrentValues(payload, k.Keys)
+	if err != nil {
+		t.Fatalf("failed to read current values: %v", err)
+	}
+	if len(duplicates) != 0 || string(values["/nginx/http/server[example.com 80]/listen"]) != "80" || string(values["/nginx/http/server[example.com 443]/listen"]) != `["443","ssl"]` {
+		t.Errorf("expected each server to have its own keys got %v, duplicates %v", values, duplicates)
+	}
+
+	o := opProvider{
+		"http/server[example.com 80]/return":                  Replace("404"),
+		"http/server[example.com 443]/location":               Replace("/app"),
+		"http/server[example.com 443]/location[/]/proxy_pass": Replace("http://127.0.0.1:9000"),
+	}
+	if err = OverridePayload(context.Background(), payload, o, nil); err != nil {
+		t.Fatalf("failed to override payload: %v", err)
+	}
+	servers := *payload.Config[0].Parsed[0].Block
+	if args := (*servers[0].Block)[2].Args; !reflect.DeepEqual(args, []string{"404"}) {
+		t.Errorf("unexpected return args: %v", args)
+	}
+	location := (*servers[1].Block)[2]
+	if !reflect.DeepEqual(location.Args, []string{"/app"}) {
+		t.Errorf("unexpected location args: %v", location.Args)
+	}
+	// children are still looked up by the name of the block in the source
+	if args := (*location.Block)[0].Args; !reflect.DeepEqual(args, []string{"http://127.0.0.1:9000"}) {
+		t.Errorf("unexpected proxy_pass args: %v", args)
+	}
+}
+
+// opProvider returns a fixed operation per block path
+type opProvider map[string]Operation
+
+func (o opProvider) Override(_ context.Context, ref DirectiveRef) (Operation, error) {
+	return o[ref.BlockPath()], nil
+}
+
+func (o opProvider) Close() error {
+	return nil
+}
+
+func TestOverrideDirectivesOperations(t *testing.T) {
+	ds := []crossplane.Directive{
+		{Directive: "listen", Args: []string{"80"}},
+		{Directive: "root", Args: []string{"html"}},
+		{Directive: "location", Args: []string{"/"}, Block: &[]crossplane.Directive{
+			{Directive: "proxy_pass", Args: []string{"http://127.0.0.1:8080"}},
+		}},
+	}
+	o := opProvider{
+		"server/listen": Replace("443", "ssl"),
+		"server/root":   {Op: OpDelete},
+		"server/location[/]/proxy_pass": {Op: OpInsert, Directives: []crossplane.Directive{
+			{Directive: "proxy_set_header", Args: []string{"Host", "$host"}},
+		}},
+		"server/location": {Op: OpInsert, Directives: []crossplane.Directive{
+			{Directive: "location", Args: []string{"/api"}, Block: &[]crossplane.Directive{
+				{Directive: "return", Args: []string{"404"}},
+			}},
+		}},
+	}
+	err := (&overrider{o: o}).overrideDirectives(context.Background(), &ds, "", []string{"server"}, 0)
+	if err != nil {
+		t.Fatalf("failed to override directives: %v", err)
+	}
+
+	var names []string
+	for _, d := range ds {
+		names = append(names, BlockName(d))
+	}
+	if !reflect.DeepEqual(names, []string{"listen[443 ssl]", "location[/]", "location[/api]"}) {
+		t.Errorf("unexpected directives: %v", names)
+	}
+	location := *ds[1].Block
+	if len(location) != 2 || location[1].Directive != "proxy_set_header" {
+		t.Errorf("expected proxy_set_header to be inserted: %+v", location)
+	}
+}
+
+func TestOverrideDirectivesReplaceAll(t *testing.T) {
+	ds := []crossplane.Directive{
+		{Directive: "server", Args: []string{"127.0.0.3:8000", "weight=5"}},
+		{Directive: "keepalive", Args: []string{"16"}},
+		{Directive: "server", Args: []string{"127.0.0.3:8001", "weight=5"}},
+		{Directive: "server", Args: []string{"192.168.0.1:8000"}},
+	}
+	o := opProvider{
+		"upstream[big_server_com]/server": ReplaceAll([]string{"10.0.0.1:8000"}, []string{"10.0.0.2:8000", "backup"}),
+	}
+	err := (&overrider{o: o}).overrideDirectives(context.Background(), &ds, "", []string{"upstream[big_server_com]"}, 0)
+	if err != nil {
+		t.Fatalf("failed to override directives: %v", err)
+	}
+
+	var names []string
+	for _, d := range ds {
+		names = append(names, BlockName(d))
+	}
+	if !reflect.DeepEqual(names, []string{"server[10.0.0.1:8000]", "server[10.0.0.2:8000 backup]", "keepalive[16]"}) {
+		t.Errorf("unexpected directives: %v", names)
+	}
+
+	block := []crossplane.Directive{{Directive: "location", Args: []string{"/"}, Block: &[]crossplane.Directive{}}}
+	err = (&overrider{o: opProvider{"location": ReplaceAll()}}).overrideDirectives(context.Background(), &block, "", nil, 0)
+	if err == nil {
+		t.Errorf("expected replacing a group of blocks to fail")
+	}
+}
+
+func TestCopyPayload(t *testing.T) {
+	var payload crossplane.Payload
+	if err := json.Unmarshal([]byte(parsedExample), &payload); err != nil {
+		t.Fatalf("failed to unmarshal test data: %v", err)
+	}
+	c, err := CopyPayload(&payload)
+	if err != nil {
+		t.Fatalf("failed to copy payload: %v", err)
+	}
+	if !reflect.DeepEqual(&payload, c) {
+		t.Fatalf("copy differs from original")
+	}
+
+	err = OverridePayload(context.Background(), c, dummyProvider{}, nil)
+	if err != nil {
+		t.Fatalf("failed to override payload: %v", err)
+	}
+	if payload.Config[0].Parsed[0].Args[0] != "www" {
+		t.Errorf("overriding the copy modified the original: %v", payload.Config[0].Parsed[0])
+	}
+}
+
+func TestWritePayloadTmpLayout(t *testing.T) {
+	var payload crossplane.Payload
+	if err := json.Unmarshal([]byte(parsedExample), &payload); err != nil {
+		t.Fatalf("failed to unmarshal test data: %v", err)
+	}
+	uFiles, err := WritePayloadTmp(&payload, &crossplane.BuildOptions{})
+	defer RemoveTmp(uFiles)
+	if err != nil {
+		t.Fatalf("failed to write files to tmp: %v", err)
+	}
+
+	tmpDir := filepath.Dir(uFiles[0].Name())
+	var files []string
+	for _, uFile := range uFiles {
+		rel, err := filepath.Rel(tmpDir, uFile.Name())
+		if err != nil {
+			t.Fatalf("failed to resolve staged file: %v", err)
+		}
+		files = append(files, rel)
+	}
+	expected := []string{"nginx.conf", "conf/mime.types", "proxy.conf", "fastcgi.conf"}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("expected '%v' got '%v'", expected, files)
+	}
+
+	// relative includes resolve against the staged main config
+	testPayload, err := crossplane.Parse(uFiles[0].Name(), &crossplane.ParseOptions{})
+	if err != nil {
+		t.Fatalf("failed to parse tmp files: %v", err)
+	}
+	if testPayload.Status != "ok" || len(testPayload.Config) != len(expected) {
+		t.Errorf("expected every include to be staged: %+v", testPayload.Errors)
+	}
+}
+
+func TestRelocatePayload(t *testing.T) {
+	payload := crossplane.Payload{Config: []crossplane.Config{
+		{File: "/etc/nginx/nginx.conf"},
+		{File: "/etc/nginx/conf/mime.types"},
+		{File: "/usr/share/nginx/modules/mod.conf"},
+	}}
+	if err := RelocatePayload(&payload, "/build"); err != nil {
+		t.Fatalf("failed to relocate payload: %v", err)
+	}
+
+	var files []string
+	for _, c := range payload.Config {
+		files = append(files, c.File)
+	}
+	expected := []string{"/build/nginx.conf", "/build/conf/mime.types", "/build/usr/share/nginx/modules/mod.conf"}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("expected '%v' got '%v'", expected, files)
+	}
+}
+
+// errProvider fails for the block paths it holds
+type errProvider map[string]bool
+
+func (o errProvider) Override(_ context.Context, ref DirectiveRef) (Operation, error) {
+	if o[ref.BlockPath()] {
+		return Operation{}, errors.New("unavailable")
+	}
+	return Operation{}, nil
+}
+
+func (o errProvider) Close() error {
+	return nil
+}
+
+func TestOverridePayloadNestedError(t *testing.T) {
+	var payload crossplane.Payload
+	if err := json.Unmarshal([]byte(parsedExample), &payload); err != nil {
+		t.Fatalf("failed to unmarshal test data: %v", err)
+	}
+	o := errProvider{
+		"http/server[domain2.com 80]/location[/]/proxy_pass": true,
+		"http/upstream[big_server_com]/server":               true,
+	}
+	err := OverridePayload(context.Background(), &payload, o, nil)
+	var dErr *DirectiveError
+	if !errors.As(err, &dErr) {
+		t.Fatalf("expected a directive error got: %v", err)
+	}
+	if dErr.File != "../../test/nginx.conf" || dErr.Line != 50 || dErr.BlockPath != "http/server[domain2.com 80]/location[/]/proxy_pass" {
+		t.Errorf("unexpected annotation: %v", dErr)
+	}
+	if dErr.Err.Error() != "unavailable" {
+		t.Errorf("expected the provider error to be wrapped: %v", dErr.Err)
+	}
+}
+
+func TestOverridePayloadCollectErrors(t *testing.T) {
+	var payload crossplane.Payload
+	if err := json.Unmarshal([]byte(parsedExample), &payload); err != nil {
+		t.Fatalf("failed to unmarshal test data: %v", err)
+	}
+	o := errProvider{
+		"http/server[domain2.com 80]/location[/]/proxy_pass": true,
+		"http/upstream[big_server_com]/server":               true,
+	}
+	err := OverridePayload(context.Background(), &payload, o, &OverrideOptions{CollectErrors: true})
+	var errs OverrideErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("expected override errors got: %v", err)
+	}
+	var lines []int
+	for _, e := range errs {
+		lines = append(lines, e.Line)
+	}
+	if !reflect.DeepEqual(lines, []int{50, 55, 56, 57, 58}) {
+		t.Errorf("unexpected failed lines: %v", lines)
+	}
+	var servers []string
+	err = WalkPayload(&payload, func(ref DirectiveRef, d *crossplane.Directive) error {
+		if ref.BlockPath() == "http/upstream[big_server_com]/server" {
+			servers = append(servers, d.Args[0])
+		}
+		return nil
+	})
+	if err != nil || len(servers) != 4 {
+		t.Errorf("expected failed directives to be kept: %v %v", servers, err)
+	}
+}
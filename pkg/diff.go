@@ -0,0 +1,79 @@
+package flywheel
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/aluttik/go-crossplane"
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// FileDiff is a unified diff of a single config file
+type FileDiff struct {
+	File string
+	Diff string
+}
+
+// DiffPayload diffs each rendered config against the file currently at its location
+//
+// The current file is parsed and built the same way as the rendered config, so a hand formatted file that was
+// never rendered only differs where its directives do. A file that doesn't exist yet is diffed against empty
+// content, and one that can't be parsed against its content as is. Only files with differences are returned; a
+// file whose only difference is its SetHeader comment isn't.
+func DiffPayload(p *crossplane.Payload, options *crossplane.BuildOptions) ([]FileDiff, error) {
+	var diffs []FileDiff
+	for _, c := range p.Config {
+		current, err := buildCurrent(c.File, options)
+		if err != nil {
+			return diffs, err
+		}
+		var rendered bytes.Buffer
+		if err = crossplane.Build(&rendered, c, options); err != nil {
+			return diffs, fmt.Errorf("failed to build NGINX config: %w", err)
+		}
+		// a header only records where the config came from, so it's not a change on its own
+		if bytes.Equal(stripHeader(current), stripHeader(rendered.Bytes())) {
+			continue
+		}
+
+		diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+			A:        difflib.SplitLines(string(current)),
+			B:        difflib.SplitLines(rendered.String()),
+			FromFile: c.File,
+			ToFile:   c.File + " (rendered)",
+			Context:  3,
+		})
+		if err != nil {
+			return diffs, fmt.Errorf("failed to diff %v: %w", c.File, err)
+		}
+		diffs = append(diffs, FileDiff{File: c.File, Diff: diff})
+	}
+	return diffs, nil
+}
+
+// buildCurrent parses and builds the file currently at path, or reads it as is when it can't be parsed
+func buildCurrent(path string, options *crossplane.BuildOptions) ([]byte, error) {
+	current, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read current config: %w", err)
+	}
+	parsed, err := crossplane.Parse(path, &crossplane.ParseOptions{
+		SingleFile:                true,
+		ParseComments:             true,
+		SkipDirectiveContextCheck: true,
+		SkipDirectiveArgsCheck:    true,
+	})
+	if err != nil || len(parsed.Errors) != 0 || len(parsed.Config) == 0 {
+		return current, nil
+	}
+	var built bytes.Buffer
+	if err = crossplane.Build(&built, parsed.Config[0], options); err != nil {
+		return current, nil
+	}
+	return built.Bytes(), nil
+}
@@ -0,0 +1,88 @@
+package flywheel
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aluttik/go-crossplane"
+)
+
+func TestDiffPayload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nginx-flywheel-test-")
+	if err != nil {
+		t.Fatalf("failed to create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	payload := crossplane.Payload{Config: []crossplane.Config{
+		{File: filepath.Join(dir, "nginx.conf"), Parsed: []crossplane.Directive{
+			{Directive: "worker_processes", Args: []string{"5"}},
+			{Directive: "pid", Args: []string{"logs/nginx.pid"}},
+		}},
+		{File: filepath.Join(dir, "proxy.conf"), Parsed: []crossplane.Directive{
+			{Directive: "proxy_redirect", Args: []string{"off"}},
+		}},
+	}}
+	if err = WritePayload(&payload, &crossplane.BuildOptions{}); err != nil {
+		t.Fatalf("failed to write payload: %v", err)
+	}
+
+	diffs, err := DiffPayload(&payload, &crossplane.BuildOptions{})
+	if err != nil {
+		t.Fatalf("failed to diff payload: %v", err)
+	}
+	if len(diffs) != 0 {
+		t.Fatalf("expected no diffs got: %+v", diffs)
+	}
+
+	payload.Config[0].Parsed[0].Args = []string{"auto"}
+	diffs, err = DiffPayload(&payload, &crossplane.BuildOptions{})
+	if err != nil {
+		t.Fatalf("failed to diff payload: %v", err)
+	}
+	if len(diffs) != 1 || diffs[0].File != payload.Config[0].File {
+		t.Fatalf("expected a single diff of nginx.conf got: %+v", diffs)
+	}
+	for _, line := range []string{"-worker_processes 5;", "+worker_processes auto;"} {
+		if !strings.Contains(diffs[0].Diff, line) {
+			t.Errorf("expected diff to contain %q: %v", line, diffs[0].Diff)
+		}
+	}
+}
+
+func TestDiffPayloadHandFormatted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nginx-flywheel-test-")
+	if err != nil {
+		t.Fatalf("failed to create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	source := filepath.Join(dir, "nginx.conf")
+	config := "# tuned by hand\nworker_processes   5;\n\nevents {\n\tworker_connections  1024;   # per worker\n}\n"
+	if err = ioutil.WriteFile(source, []byte(config), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	payload, err := crossplane.Parse(source, &crossplane.ParseOptions{ParseComments: true})
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+
+	diffs, err := DiffPayload(payload, &crossplane.BuildOptions{})
+	if err != nil {
+		t.Fatalf("failed to diff payload: %v", err)
+	}
+	if len(diffs) != 0 {
+		t.Fatalf("expected formatting alone not to be a diff got: %+v", diffs)
+	}
+
+	payload.Config[0].Parsed[1].Args = []string{"auto"}
+	diffs, err = DiffPayload(payload, &crossplane.BuildOptions{})
+	if err != nil {
+		t.Fatalf("failed to diff payload: %v", err)
+	}
+	if len(diffs) != 1 || !strings.Contains(diffs[0].Diff, "+worker_processes auto;") {
+		t.Errorf("expected the changed directive in the diff got: %+v", diffs)
+	}
+}
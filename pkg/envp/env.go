@@ -0,0 +1,154 @@
+package envp
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Brian-Williams/nginx_flywheel/pkg"
+)
+
+// DefaultPrefix is the environment variable prefix used when EnvProvider.Prefix is empty
+const DefaultPrefix = "NGINX_FLYWHEEL"
+
+// EnvProvider is a OverrideProvider for environment variables
+//
+// Keys are produced the same way as etcdp.Etcd3Provider and then mapped to a variable name by Name.
+type EnvProvider struct {
+	_ struct{}
+	// Prefix of every variable name; DefaultPrefix is used when empty
+	Prefix string
+	// LStrip is the prefix strip for NGINX config location
+	LStrip string
+	// LookupEnv reads a variable; os.LookupEnv is used when nil
+	LookupEnv func(key string) (string, bool)
+}
+
+var _ flywheel.KeyedProvider = (*EnvProvider)(nil)
+var _ flywheel.KeyResolver = (*EnvProvider)(nil)
+var _ flywheel.RelativeResolver = (*EnvProvider)(nil)
+
+// Override satisfies the OverrideProvider interface
+//
+// The first of Keys with a variable set wins. Values are decoded with flywheel.DecodeOperation.
+func (e *EnvProvider) Override(ctx context.Context, ref flywheel.DirectiveRef) (flywheel.Operation, error) {
+	for _, name := range e.Keys(ref) {
+		value, ok, _ := e.Lookup(ctx, name)
+		if !ok {
+			continue
+		}
+		op, err := flywheel.DecodeOperation(value)
+		if err != nil {
+			return flywheel.Operation{}, fmt.Errorf("invalid value for variable %v: %w", name, err)
+		}
+		return op, nil
+	}
+	return flywheel.Operation{}, nil
+}
+
+// Close satisfies the OverrideProvider interface
+func (e *EnvProvider) Close() error {
+	return nil
+}
+
+// Keys produces the variable names that are looked up for a directive, most specific first
+func (e *EnvProvider) Keys(ref flywheel.DirectiveRef) []string {
+	keys := flywheel.KeyScheme{LStrip: e.LStrip}.Keys(ref)
+	for i, key := range keys {
+		keys[i] = e.Name(key)
+	}
+	return keys
+}
+
+// BaseKey satisfies the RelativeResolver interface with the flywheel key, which Resolve maps with Name
+func (e *EnvProvider) BaseKey(ref flywheel.DirectiveRef) string {
+	return flywheel.KeyScheme{LStrip: e.LStrip}.BaseKey(ref)
+}
+
+// Key satisfies the KeyedProvider interface by mapping the key to its variable with Name
+func (e *EnvProvider) Key(key string) string {
+	return e.Name(key)
+}
+
+// Lookup satisfies the KeyedProvider interface by reading a variable
+func (e *EnvProvider) Lookup(_ context.Context, name string) ([]byte, bool, error) {
+	lookup := e.LookupEnv
+	if lookup == nil {
+		lookup = os.LookupEnv
+	}
+	value, ok := lookup(name)
+	return []byte(value), ok, nil
+}
+
+// Resolve satisfies the KeyResolver interface by reading the variable Name produces for the key
+func (e *EnvProvider) Resolve(ctx context.Context, key string) (flywheel.Operation, bool, error) {
+	name := e.Name(key)
+	value, ok, _ := e.Lookup(ctx, name)
+	if !ok {
+		return flywheel.Operation{}, false, nil
+	}
+	op, err := flywheel.DecodeOperation(value)
+	if err != nil {
+		return flywheel.Operation{}, false, fmt.Errorf("invalid value for variable %v: %w", name, err)
+	}
+	return op, true, nil
+}
+
+// Name maps a key to an environment variable name
+//
+// Each slash separated segment of the key is appended to Prefix with a double underscore. Lower case letters are
+// upper cased, digits are kept and an underscore is kept when a lower case letter follows it. Any other byte, such
+// as an upper case letter, a dot or a slash within a block name, is escaped as its lower case hex code wrapped in
+// underscores. An escape always starts with a hex digit after its underscore and a kept underscore with an upper
+// case letter, so no two keys share a name. For example with the default prefix:
+//
+//	/nginx/worker_processes                -> NGINX_FLYWHEEL__NGINX__WORKER_PROCESSES
+//	/nginx/http/server[a.com]/listen       -> NGINX_FLYWHEEL__NGINX__HTTP__SERVER_5b_A_2e_COM_5d___LISTEN
+func (e *EnvProvider) Name(key string) string {
+	prefix := e.Prefix
+	if prefix == "" {
+		prefix = DefaultPrefix
+	}
+	var b strings.Builder
+	b.WriteString(prefix)
+	for _, segment := range splitKey(strings.TrimPrefix(key, "/")) {
+		b.WriteString("__")
+		for i := 0; i < len(segment); i++ {
+			c := segment[i]
+			switch {
+			case 'a' <= c && c <= 'z':
+				b.WriteByte(c - 'a' + 'A')
+			case '0' <= c && c <= '9':
+				b.WriteByte(c)
+			case c == '_' && i+1 < len(segment) && 'a' <= segment[i+1] && segment[i+1] <= 'z':
+				b.WriteByte(c)
+			default:
+				fmt.Fprintf(&b, "_%02x_", c)
+			}
+		}
+	}
+	return b.String()
+}
+
+// splitKey splits a key on slashes that aren't within the brackets of a block name, e.g. `location[/]`
+func splitKey(key string) []string {
+	var segments []string
+	depth, start := 0, 0
+	for i := 0; i < len(key); i++ {
+		switch key[i] {
+		case '[':
+			depth++
+		case ']':
+			if depth > 0 {
+				depth--
+			}
+		case '/':
+			if depth == 0 {
+				segments = append(segments, key[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(segments, key[start:])
+}
@@ -0,0 +1,92 @@
+package envp
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/Brian-Williams/nginx_flywheel/pkg"
+)
+
+func TestName(t *testing.T) {
+	e := &EnvProvider{}
+	tests := map[string]string{
+		"/nginx/worker_processes":                      "NGINX_FLYWHEEL__NGINX__WORKER_PROCESSES",
+		"/nginx/http/server[domain1.com 443]/listen":   "NGINX_FLYWHEEL__NGINX__HTTP__SERVER_5b_DOMAIN1_2e_COM_20_443_5d___LISTEN",
+		"/conf/mime/types/application/x-javascript":    "NGINX_FLYWHEEL__CONF__MIME__TYPES__APPLICATION__X_2d_JAVASCRIPT",
+		"/nginx/http/server[a]/location[/]/proxy_pass": "NGINX_FLYWHEEL__NGINX__HTTP__SERVER_5b_A_5d___LOCATION_5b__2f__5d___PROXY_PASS",
+		"/nginx/http/location[/API]":                   "NGINX_FLYWHEEL__NGINX__HTTP__LOCATION_5b__2f__41__50__49__5d_",
+		"/nginx/a_2e_":                                 "NGINX_FLYWHEEL__NGINX__A_5f_2E_5f_",
+	}
+	for key, expected := range tests {
+		if name := e.Name(key); name != expected {
+			t.Errorf("expected '%v' got '%v'", expected, name)
+		}
+	}
+
+	// keys that only differ in case, or in an underscore next to a separator or an escape, get their own names
+	distinct := [][]string{
+		{"/nginx/http/location[/API]", "/nginx/http/location[/api]"},
+		{"/nginx/a_2e_", "/nginx/a."},
+		{"/nginx/a_/b", "/nginx/a/_b"},
+		{"/nginx/a_b", "/nginx/a/b"},
+	}
+	for _, keys := range distinct {
+		if e.Name(keys[0]) == e.Name(keys[1]) {
+			t.Errorf("expected %v and %v to have different names got %v", keys[0], keys[1], e.Name(keys[0]))
+		}
+	}
+
+	e.Prefix = "APP"
+	if name := e.Name("/nginx/listen"); name != "APP__NGINX__LISTEN" {
+		t.Errorf("unexpected name with prefix: %v", name)
+	}
+}
+
+func TestOverride(t *testing.T) {
+	env := map[string]string{
+		"NGINX_FLYWHEEL__NGINX__WORKER_PROCESSES": "4",
+		"NGINX_FLYWHEEL__NGINX__LISTEN":           "8080",
+		"NGINX_FLYWHEEL__NGINX__HTTP__SENDFILE":   `{"op": "delete"}`,
+	}
+	e := &EnvProvider{LStrip: "/etc/nginx", LookupEnv: func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	}}
+
+	tests := []struct {
+		ref      flywheel.DirectiveRef
+		expected flywheel.Operation
+	}{
+		{ref: flywheel.DirectiveRef{Directive: "worker_processes", Path: "/etc/nginx/nginx.conf"}, expected: flywheel.Replace("4")},
+		{ref: flywheel.DirectiveRef{Directive: "listen", Path: "/etc/nginx/nginx.conf", Blocks: []string{"http", "server"}}, expected: flywheel.Replace("8080")},
+		{ref: flywheel.DirectiveRef{Directive: "sendfile", Path: "/etc/nginx/nginx.conf", Blocks: []string{"http"}}, expected: flywheel.Operation{Op: flywheel.OpDelete}},
+		{ref: flywheel.DirectiveRef{Directive: "user", Path: "/etc/nginx/nginx.conf"}},
+	}
+	for _, test := range tests {
+		op, err := e.Override(context.Background(), test.ref)
+		if err != nil {
+			t.Errorf("failed to override %v: %v", test.ref.BlockPath(), err)
+			continue
+		}
+		if !reflect.DeepEqual(op, test.expected) {
+			t.Errorf("expected '%+v' got '%+v'", test.expected, op)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	e := &EnvProvider{LookupEnv: func(key string) (string, bool) {
+		if key == "NGINX_FLYWHEEL__UPSTREAMS__API__PORT" {
+			return "9000", true
+		}
+		return "", false
+	}}
+	op, ok, err := e.Resolve(context.Background(), "/upstreams/api/port")
+	if err != nil || !ok || !reflect.DeepEqual(op, flywheel.Replace("9000")) {
+		t.Errorf("unexpected resolution: %+v %v %v", op, ok, err)
+	}
+	if _, ok, err = e.Resolve(context.Background(), "/upstreams/api/host"); ok || err != nil {
+		t.Errorf("expected a missing variable: %v %v", ok, err)
+	}
+}
@@ -0,0 +1,96 @@
+package flywheel
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aluttik/go-crossplane"
+)
+
+// DirectiveError is an error overriding a directive, annotated with where the directive is
+type DirectiveError struct {
+	// File is the config file of the directive
+	File string
+	// Line is the line of the directive in File
+	Line int
+	// BlockPath is the DirectiveRef.BlockPath of the directive, e.g. http/server[domain1.com 443]/listen
+	BlockPath string
+	Err       error
+}
+
+// newDirectiveError annotates err with the location of d
+func newDirectiveError(d *crossplane.Directive, abspath string, blocks []string, err error) *DirectiveError {
+	ref := DirectiveRef{Directive: d.Directive, Path: abspath, Blocks: blocks}
+	return &DirectiveError{File: abspath, Line: d.Line, BlockPath: ref.BlockPath(), Err: err}
+}
+
+func (e *DirectiveError) Error() string {
+	return fmt.Sprintf("%v:%v: %v: %v", e.File, e.Line, e.BlockPath, e.Err)
+}
+
+func (e *DirectiveError) Unwrap() error {
+	return e.Err
+}
+
+// OverrideErrors are every error from overriding a payload when OverrideOptions.CollectErrors is set
+type OverrideErrors []*DirectiveError
+
+func (e OverrideErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%v directives failed to override: %v", len(e), strings.Join(msgs, "; "))
+}
+
+// requiredError is the error of a required directive no provider overrode
+type requiredError struct {
+	// keys are the most specific keys looked up for the directive
+	keys []string
+}
+
+func (e *requiredError) Error() string {
+	if len(e.keys) == 0 {
+		return "required directive wasn't overridden"
+	}
+	return fmt.Sprintf("required directive wasn't overridden, set %v", strings.Join(e.keys, " or "))
+}
+
+// MissingKeysError is returned by a strict run when directives annotated `# flywheel:required` weren't overridden
+type MissingKeysError struct {
+	// Directives are the required directives that weren't overridden
+	Directives []*DirectiveError
+	// Keys are the most specific keys of Directives, without duplicates, for providers that have keys
+	Keys []string
+}
+
+// newMissingKeysError lists the missing keys of directives
+func newMissingKeysError(directives []*DirectiveError) *MissingKeysError {
+	e := &MissingKeysError{Directives: directives}
+	seen := make(map[string]bool)
+	for _, d := range directives {
+		var r *requiredError
+		if !errors.As(d, &r) {
+			continue
+		}
+		for _, key := range r.keys {
+			if !seen[key] {
+				seen[key] = true
+				e.Keys = append(e.Keys, key)
+			}
+		}
+	}
+	return e
+}
+
+func (e *MissingKeysError) Error() string {
+	if len(e.Keys) != 0 {
+		return fmt.Sprintf("%v required directives weren't overridden, missing keys: %v", len(e.Directives), strings.Join(e.Keys, ", "))
+	}
+	msgs := make([]string, len(e.Directives))
+	for i, d := range e.Directives {
+		msgs[i] = fmt.Sprintf("%v:%v: %v", d.File, d.Line, d.BlockPath)
+	}
+	return fmt.Sprintf("%v required directives weren't overridden: %v", len(e.Directives), strings.Join(msgs, "; "))
+}
@@ -2,43 +2,326 @@ package etcdp
 
 import (
 	"context"
-	"path/filepath"
+	"fmt"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/Brian-Williams/nginx_flywheel/pkg"
 
 	"github.com/coreos/etcd/clientv3"
 )
 
+// DefaultMaxTxnOps is the default of etcd's --max-txn-ops, the most operations a transaction may have
+const DefaultMaxTxnOps = 128
+
 // Etcd3Provider is a OverrideProvider for etcd
 type Etcd3Provider struct {
 	_ struct{}
 	*clientv3.Client
 	// LStrip is the prefix strip for NGINX config location
 	LStrip string
+	// AtRevision pins every read to an etcd revision; 0 reads the latest revision
+	AtRevision int64
+	// MaxTxnOps is the --max-txn-ops of the etcd cluster, which Import batches writes by; 0 is DefaultMaxTxnOps
+	MaxTxnOps int
+
+	// snapshot holds every key under prefixes at revision, once prefetched
+	snapshot map[string][]byte
+	prefixes []string
+	revision int64
+	// resolved are the keys read by Resolve since the last Prefetch
+	resolved map[string]bool
 }
 
 var _ flywheel.OverrideProvider = (*Etcd3Provider)(nil)
+var _ flywheel.Prefetcher = (*Etcd3Provider)(nil)
+var _ flywheel.Versioned = (*Etcd3Provider)(nil)
+var _ flywheel.KeyedProvider = (*Etcd3Provider)(nil)
+var _ flywheel.KeyResolver = (*Etcd3Provider)(nil)
+var _ flywheel.RelativeResolver = (*Etcd3Provider)(nil)
 
 // Override satisfies the OverrideProvider interface
-func (e *Etcd3Provider) Override(ctx context.Context, directive, path string) ([]string, error) {
-	key := e.DirectiveKey(directive, path)
+//
+// The first of Keys with a value wins. Values are decoded with flywheel.DecodeOperation.
+func (e *Etcd3Provider) Override(ctx context.Context, ref flywheel.DirectiveRef) (flywheel.Operation, error) {
+	for _, key := range e.Keys(ref) {
+		value, ok, err := e.get(ctx, key)
+		if err != nil {
+			return flywheel.Operation{}, err
+		}
+		if !ok {
+			continue
+		}
+		op, err := flywheel.DecodeOperation(value)
+		if err != nil {
+			return flywheel.Operation{}, fmt.Errorf("invalid value for key %v: %w", key, err)
+		}
+		return op, nil
+	}
+	return flywheel.Operation{}, nil
+}
+
+// Prefetch satisfies the Prefetcher interface
+//
+// Every key under the Prefixes of the paths is loaded with one range request per prefix, all at the revision of
+// the first request or AtRevision, so the whole payload is rendered from a consistent view. Override serves keys under those
+// prefixes from the snapshot; any other key is read from etcd at the same revision.
+func (e *Etcd3Provider) Prefetch(ctx context.Context, paths []string) error {
+	prefixes := e.Prefixes(paths)
+	snapshot := make(map[string][]byte)
+	revision := e.AtRevision
+	for _, prefix := range prefixes {
+		opts := []clientv3.OpOption{clientv3.WithPrefix()}
+		if revision != 0 {
+			opts = append(opts, clientv3.WithRev(revision))
+		}
+		r, err := e.Client.Get(ctx, prefix, opts...)
+		if err != nil {
+			return fmt.Errorf("failed to prefetch %v: %w", prefix, err)
+		}
+		if revision == 0 {
+			revision = r.Header.Revision
+		}
+		for _, kv := range r.Kvs {
+			snapshot[string(kv.Key)] = kv.Value
+		}
+	}
+	e.snapshot, e.prefixes, e.revision = snapshot, prefixes, revision
+	e.resolved = nil
+	return nil
+}
+
+// Revision is the etcd revision of the prefetched snapshot, or AtRevision before Prefetch
+func (e *Etcd3Provider) Revision() int64 {
+	if e.revision == 0 {
+		return e.AtRevision
+	}
+	return e.revision
+}
 
+// Version satisfies the Versioned interface
+func (e *Etcd3Provider) Version() string {
+	if e.Revision() == 0 {
+		return ""
+	}
+	return fmt.Sprintf("etcd revision %d", e.Revision())
+}
+
+// Key satisfies the KeyedProvider interface; flywheel keys are etcd keys as is
+func (e *Etcd3Provider) Key(key string) string {
+	return key
+}
+
+// Lookup satisfies the KeyedProvider interface
+func (e *Etcd3Provider) Lookup(ctx context.Context, key string) ([]byte, bool, error) {
+	return e.get(ctx, key)
+}
+
+// Resolve satisfies the KeyResolver interface
+//
+// The key is recorded for ResolvedKeys.
+func (e *Etcd3Provider) Resolve(ctx context.Context, key string) (flywheel.Operation, bool, error) {
+	if e.resolved == nil {
+		e.resolved = make(map[string]bool)
+	}
+	e.resolved[key] = true
+	value, ok, err := e.get(ctx, key)
+	if err != nil || !ok {
+		return flywheel.Operation{}, false, err
+	}
+	op, err := flywheel.DecodeOperation(value)
+	if err != nil {
+		return flywheel.Operation{}, false, fmt.Errorf("invalid value for key %v: %w", key, err)
+	}
+	return op, true, nil
+}
+
+// get reads a key from the snapshot when it covers the key, otherwise from etcd
+func (e *Etcd3Provider) get(ctx context.Context, key string) ([]byte, bool, error) {
+	if e.snapshot != nil {
+		if value, ok := e.snapshot[key]; ok {
+			return value, true, nil
+		}
+		if hasPrefix(key, e.prefixes) {
+			return nil, false, nil
+		}
+	}
+
+	var opts []clientv3.OpOption
+	if e.Revision() != 0 {
+		opts = append(opts, clientv3.WithRev(e.Revision()))
+	}
 	// Context should be configured in New, so that ctx doesn't infect every method
-	r, err := e.Client.Get(ctx, key)
+	r, err := e.Client.Get(ctx, key, opts...)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
-	values := make([]string, len(r.Kvs))
-	for i, v := range r.Kvs {
-		values[i] = string(v.Value)
+	if len(r.Kvs) == 0 {
+		return nil, false, nil
 	}
-	return values, nil
+	return r.Kvs[0].Value, true, nil
+}
+
+// Keys produces the keys that are looked up for a directive, most specific first; see flywheel.KeyScheme
+func (e *Etcd3Provider) Keys(ref flywheel.DirectiveRef) []string {
+	return e.keyScheme().Keys(ref)
+}
+
+// BaseKey satisfies the RelativeResolver interface; see flywheel.KeyScheme
+func (e *Etcd3Provider) BaseKey(ref flywheel.DirectiveRef) string {
+	return e.keyScheme().BaseKey(ref)
 }
 
 // DirectiveKey produces a key from a directive and NGINX filepath
 //
 // For example directive listen with path /etc/nginx/nginx.conf and LStrip /etc/nginx would produce /nginx/listen
 func (e *Etcd3Provider) DirectiveKey(directive, path string) string {
-	return strings.TrimPrefix(filepath.Clean(strings.TrimSuffix(path, filepath.Ext(path))), e.LStrip) + "/" + directive
+	return e.keyScheme().DirectiveKey(directive, path)
+}
+
+// Prefixes produces the unique key prefixes that every directive key of the NGINX filepaths starts with
+func (e *Etcd3Provider) Prefixes(paths []string) []string {
+	return e.keyScheme().Prefixes(paths)
+}
+
+func (e *Etcd3Provider) keyScheme() flywheel.KeyScheme {
+	return flywheel.KeyScheme{LStrip: e.LStrip}
+}
+
+// ResolvedKeys are the keys read by Resolve since the last Prefetch that aren't under its prefixes, sorted
+//
+// They're the keys of templates and `flywheel:key` annotations that a render read from outside of the files' key
+// space, which Changes has to watch on their own.
+func (e *Etcd3Provider) ResolvedKeys() []string {
+	var keys []string
+	for key := range e.resolved {
+		if !hasPrefix(key, e.prefixes) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// hasPrefix reports whether key is under any of prefixes
+func hasPrefix(key string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Changes watches the Prefixes of the NGINX filepaths and each of keys, and merges their watch responses
+//
+// keys that are under the prefixes are already covered, so only the rest are watched, e.g. ResolvedKeys. A revision
+// of 0 watches from the latest revision; otherwise changes since revision are included, so watches restarted after a
+// render don't miss anything. The channel is closed once ctx is done or every underlying watch has closed. Callers
+// should check each response's Err.
+func (e *Etcd3Provider) Changes(ctx context.Context, paths, keys []string, revision int64) <-chan clientv3.WatchResponse {
+	var opts []clientv3.OpOption
+	if revision != 0 {
+		opts = append(opts, clientv3.WithRev(revision))
+	}
+	prefixes := e.Prefixes(paths)
+	var watches []clientv3.WatchChan
+	for _, prefix := range prefixes {
+		watches = append(watches, e.Client.Watch(ctx, prefix, append(opts[:len(opts):len(opts)], clientv3.WithPrefix())...))
+	}
+	for _, key := range keys {
+		if !hasPrefix(key, prefixes) {
+			watches = append(watches, e.Client.Watch(ctx, key, opts...))
+		}
+	}
+
+	out := make(chan clientv3.WatchResponse)
+	var wg sync.WaitGroup
+	for _, wc := range watches {
+		wc := wc
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for resp := range wc {
+				select {
+				case out <- resp:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out
+}
+
+// Import writes values to etcd in transactions of at most MaxTxnOps keys, in key order
+//
+// With skipExisting, keys that already exist are left alone and returned; a transaction then fails rather than
+// overwrite a key that's created concurrently. The batches aren't atomic together, so when one fails the keys of the
+// batches before it stay written; importing again with skipExisting picks up where it stopped.
+func (e *Etcd3Provider) Import(ctx context.Context, values map[string][]byte, skipExisting bool) ([]string, error) {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	var skipped []string
+	var cmps []clientv3.Cmp
+	if skipExisting {
+		// one range covering every key finds the existing ones
+		r, err := e.Client.Get(ctx, keys[0], clientv3.WithRange(keys[len(keys)-1]+"\x00"), clientv3.WithKeysOnly())
+		if err != nil {
+			return nil, fmt.Errorf("failed to read existing keys: %w", err)
+		}
+		existing := make(map[string]bool, len(r.Kvs))
+		for _, kv := range r.Kvs {
+			existing[string(kv.Key)] = true
+		}
+		remaining := keys[:0]
+		for _, key := range keys {
+			if existing[key] {
+				skipped = append(skipped, key)
+				continue
+			}
+			remaining = append(remaining, key)
+			cmps = append(cmps, clientv3.Compare(clientv3.CreateRevision(key), "=", 0))
+		}
+		keys = remaining
+	}
+
+	batch := e.MaxTxnOps
+	if batch <= 0 {
+		batch = DefaultMaxTxnOps
+	}
+	for start := 0; start < len(keys); start += batch {
+		end := start + batch
+		if end > len(keys) {
+			end = len(keys)
+		}
+		ops := make([]clientv3.Op, 0, end-start)
+		for _, key := range keys[start:end] {
+			ops = append(ops, clientv3.OpPut(key, string(values[key])))
+		}
+		var batchCmps []clientv3.Cmp
+		if skipExisting {
+			batchCmps = cmps[start:end]
+		}
+		r, err := e.Client.Txn(ctx).If(batchCmps...).Then(ops...).Commit()
+		if err != nil {
+			return skipped, fmt.Errorf("failed to import keys after %v of %v: %w", start, len(keys), err)
+		}
+		if !r.Succeeded {
+			return skipped, fmt.Errorf("failed to import keys after %v of %v: some were created concurrently", start, len(keys))
+		}
+	}
+	return skipped, nil
 }
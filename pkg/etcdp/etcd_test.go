@@ -0,0 +1,317 @@
+package etcdp
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/Brian-Williams/nginx_flywheel/pkg"
+
+	"github.com/coreos/etcd/clientv3"
+	pb "github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+)
+
+// fakeKV is an in memory clientv3.KV that keeps every revision
+type fakeKV struct {
+	clientv3.KV
+	// history holds the puts in revision order; revision n is history[n-1]
+	history []mvccpb.KeyValue
+	gets    int
+}
+
+func (f *fakeKV) put(key, value string) {
+	f.history = append(f.history, mvccpb.KeyValue{Key: []byte(key), Value: []byte(value), ModRevision: int64(len(f.history) + 1)})
+}
+
+func (f *fakeKV) Get(_ context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	f.gets++
+	op := clientv3.OpGet(key, opts...)
+	revision := op.Rev()
+	if revision == 0 {
+		revision = int64(len(f.history))
+	}
+	end := string(op.RangeBytes())
+
+	latest := make(map[string]mvccpb.KeyValue)
+	for _, kv := range f.history[:revision] {
+		k := string(kv.Key)
+		if k == key || (end != "" && k >= key && (end == "\x00" || k < end)) {
+			latest[k] = kv
+		}
+	}
+	resp := &clientv3.GetResponse{Header: &pb.ResponseHeader{Revision: revision}}
+	for _, kv := range latest {
+		kv := kv
+		resp.Kvs = append(resp.Kvs, &kv)
+	}
+	sort.Slice(resp.Kvs, func(i, j int) bool { return strings.Compare(string(resp.Kvs[i].Key), string(resp.Kvs[j].Key)) < 0 })
+	return resp, nil
+}
+
+func (f *fakeKV) Txn(_ context.Context) clientv3.Txn {
+	return &fakeTxn{kv: f}
+}
+
+// fakeTxn only supports comparing that keys weren't created, as used by Import
+type fakeTxn struct {
+	kv   *fakeKV
+	cmps []clientv3.Cmp
+	ops  []clientv3.Op
+}
+
+func (t *fakeTxn) If(cs ...clientv3.Cmp) clientv3.Txn {
+	t.cmps = append(t.cmps, cs...)
+	return t
+}
+
+func (t *fakeTxn) Then(ops ...clientv3.Op) clientv3.Txn {
+	t.ops = append(t.ops, ops...)
+	return t
+}
+
+func (t *fakeTxn) Else(ops ...clientv3.Op) clientv3.Txn {
+	return t
+}
+
+func (t *fakeTxn) Commit() (*clientv3.TxnResponse, error) {
+	for _, c := range t.cmps {
+		r, _ := t.kv.Get(context.Background(), string(c.KeyBytes()))
+		if len(r.Kvs) != 0 {
+			return &clientv3.TxnResponse{Succeeded: false}, nil
+		}
+	}
+	for _, op := range t.ops {
+		t.kv.put(string(op.KeyBytes()), string(op.ValueBytes()))
+	}
+	return &clientv3.TxnResponse{Succeeded: true}, nil
+}
+
+func TestPrefetch(t *testing.T) {
+	kv := &fakeKV{}
+	kv.put("/nginx/listen", "80")
+	kv.put("/nginx/http/server[domain1.com 443]/listen", "443")
+	kv.put("/conf/mime/types/text/html", "html")
+	kv.put("/other/listen", "1")
+	e := &Etcd3Provider{Client: &clientv3.Client{KV: kv}, LStrip: "/etc/nginx"}
+
+	err := e.Prefetch(context.Background(), []string{"/etc/nginx/nginx.conf", "/etc/nginx/conf/mime.types"})
+	if err != nil {
+		t.Fatalf("failed to prefetch: %v", err)
+	}
+	if e.Revision() != 4 {
+		t.Errorf("expected revision 4 got %v", e.Revision())
+	}
+	// changes after the prefetch aren't seen
+	kv.put("/nginx/listen", "8080")
+	kv.gets = 0
+
+	tests := []struct {
+		ref      flywheel.DirectiveRef
+		expected flywheel.Operation
+	}{
+		{ref: flywheel.DirectiveRef{Directive: "listen", Path: "/etc/nginx/nginx.conf", Blocks: []string{"http", "server[domain1.com 443]"}}, expected: flywheel.Replace("443")},
+		{ref: flywheel.DirectiveRef{Directive: "listen", Path: "/etc/nginx/nginx.conf", Blocks: []string{"http", "server[domain2.com 443]"}}, expected: flywheel.Replace("80")},
+		{ref: flywheel.DirectiveRef{Directive: "text/html", Path: "/etc/nginx/conf/mime.types", Blocks: []string{"types"}}, expected: flywheel.Replace("html")},
+		{ref: flywheel.DirectiveRef{Directive: "user", Path: "/etc/nginx/nginx.conf"}},
+	}
+	for _, test := range tests {
+		op, err := e.Override(context.Background(), test.ref)
+		if err != nil {
+			t.Errorf("failed to override %v: %v", test.ref.BlockPath(), err)
+			continue
+		}
+		if !reflect.DeepEqual(op, test.expected) {
+			t.Errorf("%v: expected '%+v' got '%+v'", test.ref.BlockPath(), test.expected, op)
+		}
+	}
+	if kv.gets != 0 {
+		t.Errorf("expected lookups to be served from the snapshot, got %v gets", kv.gets)
+	}
+
+	// keys outside the prefetched prefixes are read at the snapshot revision
+	op, err := e.Override(context.Background(), flywheel.DirectiveRef{Directive: "listen", Path: "/etc/nginx/other.conf"})
+	if err != nil {
+		t.Fatalf("failed to override: %v", err)
+	}
+	if !reflect.DeepEqual(op, flywheel.Replace("1")) || kv.gets != 1 {
+		t.Errorf("expected a single get of the other key, got '%+v' with %v gets", op, kv.gets)
+	}
+}
+
+func TestAtRevision(t *testing.T) {
+	kv := &fakeKV{}
+	kv.put("/nginx/listen", "80")
+	kv.put("/nginx/listen", "8080")
+	e := &Etcd3Provider{Client: &clientv3.Client{KV: kv}, LStrip: "/etc/nginx", AtRevision: 1}
+
+	ref := flywheel.DirectiveRef{Directive: "listen", Path: "/etc/nginx/nginx.conf"}
+	op, err := e.Override(context.Background(), ref)
+	if err != nil {
+		t.Fatalf("failed to override: %v", err)
+	}
+	if !reflect.DeepEqual(op, flywheel.Replace("80")) {
+		t.Errorf("expected the value at revision 1 without prefetch got '%+v'", op)
+	}
+
+	if err = e.Prefetch(context.Background(), []string{ref.Path}); err != nil {
+		t.Fatalf("failed to prefetch: %v", err)
+	}
+	op, err = e.Override(context.Background(), ref)
+	if err != nil {
+		t.Fatalf("failed to override: %v", err)
+	}
+	if !reflect.DeepEqual(op, flywheel.Replace("80")) {
+		t.Errorf("expected the value at revision 1 after prefetch got '%+v'", op)
+	}
+	if e.Version() != "etcd revision 1" {
+		t.Errorf("unexpected version: %v", e.Version())
+	}
+}
+
+// fakeWatcher records each watch and closes it straight away
+type fakeWatcher struct {
+	clientv3.Watcher
+	watches []string
+}
+
+func (w *fakeWatcher) Watch(_ context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	op := clientv3.OpGet(key, opts...)
+	w.watches = append(w.watches, fmt.Sprintf("%v prefix=%t rev=%d", key, op.RangeBytes() != nil, op.Rev()))
+	wc := make(chan clientv3.WatchResponse)
+	close(wc)
+	return wc
+}
+
+func TestResolvedKeys(t *testing.T) {
+	kv := &fakeKV{}
+	kv.put("/nginx/listen", "80")
+	kv.put("/upstreams/api/port", "9000")
+	w := &fakeWatcher{}
+	e := &Etcd3Provider{Client: &clientv3.Client{KV: kv, Watcher: w}, LStrip: "/etc"}
+	paths := []string{"/etc/nginx/nginx.conf"}
+
+	if err := e.Prefetch(context.Background(), paths); err != nil {
+		t.Fatalf("failed to prefetch: %v", err)
+	}
+	for _, key := range []string{"/upstreams/api/port", "/nginx/nginx/listen", "/upstreams/api/host"} {
+		if _, _, err := e.Resolve(context.Background(), key); err != nil {
+			t.Fatalf("failed to resolve %v: %v", key, err)
+		}
+	}
+	keys := e.ResolvedKeys()
+	if !reflect.DeepEqual(keys, []string{"/upstreams/api/host", "/upstreams/api/port"}) {
+		t.Errorf("expected the keys outside of the prefixes got: %v", keys)
+	}
+
+	for range e.Changes(context.Background(), paths, append(keys, "/nginx/nginx/pid"), 3) {
+	}
+	expected := []string{
+		"/nginx/nginx/ prefix=true rev=3",
+		"/upstreams/api/host prefix=false rev=3",
+		"/upstreams/api/port prefix=false rev=3",
+	}
+	if !reflect.DeepEqual(w.watches, expected) {
+		t.Errorf("expected watches %v got %v", expected, w.watches)
+	}
+
+	if err := e.Prefetch(context.Background(), paths); err != nil {
+		t.Fatalf("failed to prefetch: %v", err)
+	}
+	if keys = e.ResolvedKeys(); len(keys) != 0 {
+		t.Errorf("expected a prefetch to start a new render got: %v", keys)
+	}
+}
+
+func TestImport(t *testing.T) {
+	kv := &fakeKV{}
+	kv.put("/nginx/listen", "80")
+	e := &Etcd3Provider{Client: &clientv3.Client{KV: kv}}
+
+	values := map[string][]byte{"/nginx/listen": []byte("8080"), "/nginx/user": []byte("www")}
+	skipped, err := e.Import(context.Background(), values, true)
+	if err != nil {
+		t.Fatalf("failed to import: %v", err)
+	}
+	if !reflect.DeepEqual(skipped, []string{"/nginx/listen"}) {
+		t.Errorf("expected existing key to be skipped got: %v", skipped)
+	}
+	r, _ := kv.Get(context.Background(), "/nginx/", clientv3.WithPrefix())
+	if len(r.Kvs) != 2 || string(r.Kvs[0].Value) != "80" || string(r.Kvs[1].Value) != "www" {
+		t.Errorf("unexpected keys after import: %v", r.Kvs)
+	}
+
+	if _, err = e.Import(context.Background(), values, false); err != nil {
+		t.Fatalf("failed to import: %v", err)
+	}
+	r, _ = kv.Get(context.Background(), "/nginx/listen")
+	if string(r.Kvs[0].Value) != "8080" {
+		t.Errorf("expected existing key to be overwritten got: %s", r.Kvs[0].Value)
+	}
+}
+
+// countingKV counts the transactions committed and their largest number of operations
+type countingKV struct {
+	*fakeKV
+	txns   int
+	maxOps int
+}
+
+func (c *countingKV) Txn(ctx context.Context) clientv3.Txn {
+	return &countingTxn{Txn: c.fakeKV.Txn(ctx), kv: c}
+}
+
+type countingTxn struct {
+	clientv3.Txn
+	kv  *countingKV
+	ops int
+}
+
+func (t *countingTxn) If(cs ...clientv3.Cmp) clientv3.Txn {
+	if len(cs) > t.ops {
+		t.ops = len(cs)
+	}
+	t.Txn.If(cs...)
+	return t
+}
+
+func (t *countingTxn) Then(ops ...clientv3.Op) clientv3.Txn {
+	if len(ops) > t.ops {
+		t.ops = len(ops)
+	}
+	t.Txn.Then(ops...)
+	return t
+}
+
+func (t *countingTxn) Commit() (*clientv3.TxnResponse, error) {
+	t.kv.txns++
+	if t.ops > t.kv.maxOps {
+		t.kv.maxOps = t.ops
+	}
+	return t.Txn.Commit()
+}
+
+func TestImportBatches(t *testing.T) {
+	kv := &countingKV{fakeKV: &fakeKV{}}
+	kv.put("/nginx/key000", "existing")
+	e := &Etcd3Provider{Client: &clientv3.Client{KV: kv}}
+
+	values := make(map[string][]byte)
+	for i := 0; i < 300; i++ {
+		values[fmt.Sprintf("/nginx/key%03d", i)] = []byte(fmt.Sprint(i))
+	}
+	skipped, err := e.Import(context.Background(), values, true)
+	if err != nil {
+		t.Fatalf("failed to import: %v", err)
+	}
+	if len(skipped) != 1 || kv.txns != 3 || kv.maxOps != DefaultMaxTxnOps {
+		t.Errorf("expected 299 keys in 3 transactions of at most %v got %v, %v, %v", DefaultMaxTxnOps, skipped, kv.txns, kv.maxOps)
+	}
+	r, _ := kv.Get(context.Background(), "/nginx/", clientv3.WithPrefix())
+	if len(r.Kvs) != 300 || string(r.Kvs[299].Value) != "299" {
+		t.Errorf("expected every key to be imported got %v", len(r.Kvs))
+	}
+}
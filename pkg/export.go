@@ -0,0 +1,139 @@
+package flywheel
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aluttik/go-crossplane"
+)
+
+// KeyedProvider is an OverrideProvider backed by a key value store, which lets its key space be exported
+type KeyedProvider interface {
+	OverrideProvider
+	// Keys produces the keys looked up for a directive, most specific first
+	Keys(ref DirectiveRef) []string
+	// Key maps a flywheel key, such as a `flywheel:key` annotation or a template key, to the key Lookup reads
+	Key(key string) string
+	// Lookup reads the raw value of a key; false is returned when the key doesn't exist
+	Lookup(ctx context.Context, key string) ([]byte, bool, error)
+}
+
+// KeyEntry is a key that's looked up while overriding a payload
+type KeyEntry struct {
+	Key string `json:"key"`
+	// Provider is the index of the provider within a Chain, or 0
+	Provider int `json:"provider"`
+	// File, Line and BlockPath locate the first directive the key is looked up for
+	File      string `json:"file"`
+	Line      int    `json:"line"`
+	BlockPath string `json:"block_path"`
+	// Directives is the number of directives the key is looked up for
+	Directives int    `json:"directives"`
+	Exists     bool   `json:"exists"`
+	Value      string `json:"value,omitempty"`
+}
+
+// ExportKeys lists every key the provider would look up for the payload, in the order they're first looked up
+//
+// The provider must be a KeyedProvider or a Chain of them. Annotations are honored the same as OverridePayload: a
+// `flywheel:skip` directive and its block aren't listed, and a `flywheel:key` replaces the keys of its directive.
+// The keys named by the templates in the args of a directive, or of its `flywheel:default`, are listed after the
+// keys of the directive, as they're looked up when rendering with OverrideOptions.Templates.
+func ExportKeys(ctx context.Context, p *crossplane.Payload, o OverrideProvider) ([]KeyEntry, error) {
+	if pf, ok := o.(Prefetcher); ok {
+		paths := make([]string, len(p.Config))
+		for i, c := range p.Config {
+			paths[i] = c.File
+		}
+		if err := pf.Prefetch(ctx, paths); err != nil {
+			return nil, fmt.Errorf("failed to prefetch overrides: %w", err)
+		}
+	}
+
+	var providers []KeyedProvider
+	switch o := o.(type) {
+	case *Chain:
+		for i, child := range o.Providers {
+			k, ok := child.(KeyedProvider)
+			if !ok {
+				return nil, fmt.Errorf("provider %v doesn't support exporting keys", i)
+			}
+			providers = append(providers, k)
+		}
+	case KeyedProvider:
+		providers = append(providers, o)
+	default:
+		return nil, fmt.Errorf("provider doesn't support exporting keys")
+	}
+
+	var entries []KeyEntry
+	for i, k := range providers {
+		index := make(map[string]int)
+		err := walkAnnotated(p, func(ref DirectiveRef, d *crossplane.Directive, a annotations) error {
+			if a.skip {
+				return nil
+			}
+			keys := k.Keys(ref)
+			if a.key != "" {
+				keys = []string{k.Key(a.key)}
+			}
+			templateKeys, err := directiveTemplateKeys(k, ref, d, a)
+			if err != nil {
+				return newDirectiveError(d, ref.Path, ref.Blocks, err)
+			}
+			for _, key := range templateKeys {
+				keys = append(keys, k.Key(key))
+			}
+			counted := make(map[string]bool, len(keys))
+			for _, key := range keys {
+				if counted[key] {
+					continue
+				}
+				counted[key] = true
+				if j, ok := index[key]; ok {
+					entries[j].Directives++
+					continue
+				}
+				value, exists, err := k.Lookup(ctx, key)
+				if err != nil {
+					return fmt.Errorf("failed to look up %v: %w", key, err)
+				}
+				index[key] = len(entries)
+				entries = append(entries, KeyEntry{
+					Key:        key,
+					Provider:   i,
+					File:       ref.Path,
+					Line:       d.Line,
+					BlockPath:  ref.BlockPath(),
+					Directives: 1,
+					Exists:     exists,
+					Value:      string(value),
+				})
+			}
+			return nil
+		})
+		if err != nil {
+			return entries, err
+		}
+	}
+	return entries, nil
+}
+
+// directiveTemplateKeys are the flywheel keys named by the templates in the source args of d and of its default
+func directiveTemplateKeys(k KeyedProvider, ref DirectiveRef, d *crossplane.Directive, a annotations) ([]string, error) {
+	args := d.Args
+	if a.defaultOp != nil {
+		args = append(args[:len(args):len(args)], a.defaultOp.Args...)
+		for _, argSet := range a.defaultOp.ArgSets {
+			args = append(args, argSet...)
+		}
+	}
+	if !hasTemplate(args) {
+		return nil, nil
+	}
+	base := ""
+	if r, ok := k.(RelativeResolver); ok {
+		base = r.BaseKey(ref)
+	}
+	return TemplateKeys(args, base)
+}
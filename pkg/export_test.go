@@ -0,0 +1,143 @@
+package flywheel
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/aluttik/go-crossplane"
+)
+
+// keyedProvider is a KeyedProvider over raw values by key, with every key placed under prefix
+type keyedProvider struct {
+	KeyScheme
+	prefix string
+	values map[string]string
+}
+
+func (k keyedProvider) Keys(ref DirectiveRef) []string {
+	keys := k.KeyScheme.Keys(ref)
+	for i, key := range keys {
+		keys[i] = k.Key(key)
+	}
+	return keys
+}
+
+func (k keyedProvider) Key(key string) string {
+	return k.prefix + key
+}
+
+func (k keyedProvider) Override(ctx context.Context, ref DirectiveRef) (Operation, error) {
+	for _, key := range k.Keys(ref) {
+		if value, ok := k.values[key]; ok {
+			return DecodeOperation([]byte(value))
+		}
+	}
+	return Operation{}, nil
+}
+
+func (k keyedProvider) Lookup(_ context.Context, key string) ([]byte, bool, error) {
+	value, ok := k.values[key]
+	return []byte(value), ok, nil
+}
+
+func (k keyedProvider) Resolve(_ context.Context, key string) (Operation, bool, error) {
+	value, ok := k.values[k.Key(key)]
+	if !ok {
+		return Operation{}, false, nil
+	}
+	op, err := DecodeOperation([]byte(value))
+	return op, err == nil, err
+}
+
+func (k keyedProvider) Close() error {
+	return nil
+}
+
+func TestExportKeys(t *testing.T) {
+	var payload crossplane.Payload
+	if err := json.Unmarshal([]byte(parsedExample), &payload); err != nil {
+		t.Fatalf("failed to unmarshal test data: %v", err)
+	}
+	k := keyedProvider{KeyScheme: KeyScheme{LStrip: "../../test"}, values: map[string]string{"/nginx/listen": "8080"}}
+
+	entries, err := ExportKeys(context.Background(), &payload, k)
+	if err != nil {
+		t.Fatalf("failed to export keys: %v", err)
+	}
+	if entries[0].Key != "/nginx/user" || entries[0].Line != 1 || entries[0].Exists {
+		t.Errorf("unexpected first entry: %+v", entries[0])
+	}
+	seen := make(map[string]bool)
+	for _, e := range entries {
+		if seen[e.Key] {
+			t.Errorf("duplicate entry for %v", e.Key)
+		}
+		seen[e.Key] = true
+		if e.Key == "/nginx/listen" && (!e.Exists || e.Value != "8080" || e.Directives != 3 || e.Line != 27) {
+			t.Errorf("unexpected listen entry: %+v", e)
+		}
+	}
+
+	entries, err = ExportKeys(context.Background(), &payload, &Chain{Providers: []OverrideProvider{k, k}})
+	if err != nil {
+		t.Fatalf("failed to export chain keys: %v", err)
+	}
+	if entries[len(entries)-1].Provider != 1 || len(entries) != 2*len(seen) {
+		t.Errorf("expected each provider's keys in the chain export")
+	}
+
+	if _, err = ExportKeys(context.Background(), &payload, dummyProvider{}); err == nil {
+		t.Errorf("expected a provider without keys to fail")
+	}
+}
+
+func TestExportKeysAnnotations(t *testing.T) {
+	payload := parseAnnotated(t, `worker_processes 5; # flywheel:skip
+# flywheel:key=/shared/error_log
+error_log logs/error.log;
+
+events { # flywheel:skip
+  worker_connections 1024;
+}
+`)
+	k := keyedProvider{
+		KeyScheme: KeyScheme{LStrip: filepath.Dir(payload.Config[0].File)},
+		prefix:    "prefix",
+		values:    map[string]string{"prefix/shared/error_log": "stderr"},
+	}
+	entries, err := ExportKeys(context.Background(), payload, k)
+	if err != nil {
+		t.Fatalf("failed to export keys: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Key != "prefix/shared/error_log" || !entries[0].Exists || entries[0].Line != 3 {
+		t.Errorf("expected only the custom key got: %+v", entries)
+	}
+}
+
+func TestExportKeysTemplates(t *testing.T) {
+	payload := parseAnnotated(t, `worker_processes '{{ key "/workers" | default "auto" }}';
+error_log '{{ key "/logs/dir" }}/error.log' '{{ key "/logs/level" }}'; # flywheel:default='{{ key "/logs/dir" }}/default.log'
+`)
+	k := keyedProvider{KeyScheme: KeyScheme{LStrip: filepath.Dir(payload.Config[0].File)}, values: map[string]string{"/workers": "4"}}
+	entries, err := ExportKeys(context.Background(), payload, k)
+	if err != nil {
+		t.Fatalf("failed to export keys: %v", err)
+	}
+	var keys []string
+	for _, e := range entries {
+		keys = append(keys, e.Key)
+		if e.Key == "/workers" && (!e.Exists || e.Value != "4") {
+			t.Errorf("unexpected template key entry: %+v", e)
+		}
+		if e.Key == "/logs/dir" && e.Directives != 1 {
+			t.Errorf("expected a key used twice by a directive to count it once: %+v", e)
+		}
+	}
+	expected := []string{"/nginx/worker_processes", "/workers", "/nginx/error_log", "/logs/dir", "/logs/level"}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected %v got %v", expected, keys)
+	}
+}
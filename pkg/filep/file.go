@@ -0,0 +1,154 @@
+package filep
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/Brian-Williams/nginx_flywheel/pkg"
+
+	yamlv2 "gopkg.in/yaml.v2"
+	"sigs.k8s.io/yaml"
+)
+
+// FileProvider is a OverrideProvider for a local YAML or JSON document
+//
+// The document maps keys, produced the same way as etcdp.Etcd3Provider, to values:
+//
+//	/nginx/worker_processes: "4"
+//	/nginx/http/server[domain1.com 443]/listen: ["443", "ssl"]
+//	/nginx/http/sendfile: {"op": "delete"}
+//	/nginx/http/upstream[backend]/server: [["10.0.0.1:8000"], ["10.0.0.2:8000", "backup"]]
+//
+// Strings, lists of strings, lists of lists of strings and objects are all decoded with flywheel.DecodeOperation, the same as a value
+// stored in etcd. Unquoted scalars are kept exactly as written, so `gzip: on` stays `on` rather than becoming a YAML
+// boolean, and an empty value is an error.
+type FileProvider struct {
+	_ struct{}
+	// Overrides are the decoded values by key
+	Overrides map[string]flywheel.Operation
+	// LStrip is the prefix strip for NGINX config location
+	LStrip string
+}
+
+var _ flywheel.KeyedProvider = (*FileProvider)(nil)
+var _ flywheel.KeyResolver = (*FileProvider)(nil)
+var _ flywheel.RelativeResolver = (*FileProvider)(nil)
+
+// Override satisfies the OverrideProvider interface
+//
+// The first of Keys with a value wins.
+func (f *FileProvider) Override(_ context.Context, ref flywheel.DirectiveRef) (flywheel.Operation, error) {
+	for _, key := range f.Keys(ref) {
+		if op, ok := f.Overrides[key]; ok {
+			return op, nil
+		}
+	}
+	return flywheel.Operation{}, nil
+}
+
+// Keys produces the keys that are looked up for a directive, most specific first
+func (f *FileProvider) Keys(ref flywheel.DirectiveRef) []string {
+	return flywheel.KeyScheme{LStrip: f.LStrip}.Keys(ref)
+}
+
+// BaseKey satisfies the RelativeResolver interface; see flywheel.KeyScheme
+func (f *FileProvider) BaseKey(ref flywheel.DirectiveRef) string {
+	return flywheel.KeyScheme{LStrip: f.LStrip}.BaseKey(ref)
+}
+
+// Key satisfies the KeyedProvider interface; the document is keyed by flywheel keys as is
+func (f *FileProvider) Key(key string) string {
+	return key
+}
+
+// Lookup satisfies the KeyedProvider interface; the value is the decoded operation as JSON
+func (f *FileProvider) Lookup(_ context.Context, key string) ([]byte, bool, error) {
+	op, ok := f.Overrides[key]
+	if !ok {
+		return nil, false, nil
+	}
+	value, err := json.Marshal(op)
+	return value, true, err
+}
+
+// Resolve satisfies the KeyResolver interface
+func (f *FileProvider) Resolve(_ context.Context, key string) (flywheel.Operation, bool, error) {
+	op, ok := f.Overrides[key]
+	return op, ok, nil
+}
+
+// Close satisfies the OverrideProvider interface
+func (f *FileProvider) Close() error {
+	return nil
+}
+
+// ReadFile reads and decodes an overrides document
+func ReadFile(path string) (map[string]flywheel.Operation, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read overrides: %w", err)
+	}
+	overrides, err := Decode(b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %v: %w", path, err)
+	}
+	return overrides, nil
+}
+
+// scalarText is the text of a YAML scalar as written, before it's resolved to a boolean, number or null
+type scalarText struct {
+	text string
+	ok   bool
+}
+
+// UnmarshalYAML satisfies the yaml.v2 Unmarshaler interface; anything but a non-null scalar is left empty
+func (s *scalarText) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&s.text); err == nil {
+		s.ok = true
+	}
+	return nil
+}
+
+// Decode decodes a YAML or JSON overrides document
+func Decode(b []byte) (map[string]flywheel.Operation, error) {
+	var raw map[string]json.RawMessage
+	if err := yaml.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal overrides: %w", err)
+	}
+	// converting to JSON resolves `on` to true and `1.10` to 1.1, so scalars are read again as written
+	var scalars map[string]scalarText
+	if err := yamlv2.Unmarshal(b, &scalars); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal overrides: %w", err)
+	}
+	overrides := make(map[string]flywheel.Operation, len(raw))
+	for key, value := range raw {
+		op, err := decodeValue(value, scalars[key])
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for key %v: %w", key, err)
+		}
+		overrides[key] = op
+	}
+	return overrides, nil
+}
+
+// decodeValue decodes the JSON of a value; scalar is the value as written when it's a YAML scalar
+func decodeValue(value json.RawMessage, scalar scalarText) (flywheel.Operation, error) {
+	switch {
+	case bytes.HasPrefix(value, []byte(`"`)):
+		var s string
+		if err := json.Unmarshal(value, &s); err != nil {
+			return flywheel.Operation{}, err
+		}
+		return flywheel.DecodeOperation([]byte(s))
+	case bytes.HasPrefix(value, []byte("[")), bytes.HasPrefix(value, []byte("{")):
+		return flywheel.DecodeOperation(value)
+	case !scalar.ok:
+		return flywheel.Operation{}, fmt.Errorf("empty value, use {\"op\": \"delete\"} to remove the directive")
+	default:
+		// numbers and booleans as written, e.g. `worker_processes: 4` or `gzip: on`
+		return flywheel.DecodeOperation([]byte(scalar.text))
+	}
+}
@@ -0,0 +1,89 @@
+package filep
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/Brian-Williams/nginx_flywheel/pkg"
+	"github.com/aluttik/go-crossplane"
+)
+
+func TestOverridePayload(t *testing.T) {
+	source, err := filepath.Abs("testdata/nginx.conf")
+	if err != nil {
+		t.Fatalf("failed to resolve test config: %v", err)
+	}
+	payload, err := crossplane.Parse(source, &crossplane.ParseOptions{})
+	if err != nil {
+		t.Fatalf("failed to parse test config: %v", err)
+	}
+	overrides, err := ReadFile("testdata/overrides.yaml")
+	if err != nil {
+		t.Fatalf("failed to read overrides: %v", err)
+	}
+
+	f := &FileProvider{Overrides: overrides, LStrip: filepath.Dir(source)}
+	if err = flywheel.OverridePayload(context.Background(), payload, f, nil); err != nil {
+		t.Fatalf("failed to override payload: %v", err)
+	}
+
+	var rendered bytes.Buffer
+	if err = crossplane.Build(&rendered, payload.Config[0], &crossplane.BuildOptions{}); err != nil {
+		t.Fatalf("failed to build config: %v", err)
+	}
+	expected := `user nginx nginx;
+worker_processes 4;
+http {
+    server {
+        listen 443 ssl;
+        server_name domain1.com;
+        location / {
+            proxy_pass http://127.0.0.1:9000;
+        }
+    }
+    server {
+        listen 8080;
+        server_name domain2.com;
+    }
+}`
+	if rendered.String() != expected {
+		t.Errorf("expected:\n%v\ngot:\n%v", expected, rendered.String())
+	}
+}
+
+func TestDecode(t *testing.T) {
+	overrides, err := Decode([]byte(`{"/nginx/listen": ["80", "default_server"], "/nginx/gzip": "on"}`))
+	if err != nil {
+		t.Fatalf("failed to decode JSON: %v", err)
+	}
+	expected := map[string]flywheel.Operation{
+		"/nginx/listen": flywheel.Replace("80", "default_server"),
+		"/nginx/gzip":   flywheel.Replace("on"),
+	}
+	if !reflect.DeepEqual(overrides, expected) {
+		t.Errorf("expected '%+v' got '%+v'", expected, overrides)
+	}
+
+	overrides, err = Decode([]byte("/nginx/gzip: on\n/nginx/sendfile: off\n/nginx/version: 1.10\n/nginx/worker_processes: 4\n"))
+	if err != nil {
+		t.Fatalf("failed to decode YAML: %v", err)
+	}
+	expected = map[string]flywheel.Operation{
+		"/nginx/gzip":             flywheel.Replace("on"),
+		"/nginx/sendfile":         flywheel.Replace("off"),
+		"/nginx/version":          flywheel.Replace("1.10"),
+		"/nginx/worker_processes": flywheel.Replace("4"),
+	}
+	if !reflect.DeepEqual(overrides, expected) {
+		t.Errorf("expected scalars as written '%+v' got '%+v'", expected, overrides)
+	}
+
+	for _, invalid := range []string{`/nginx/listen: [1, [2]]`, `/nginx/listen: {"op": "rename"}`, `[]`, "/nginx/listen:\n"} {
+		if _, err = Decode([]byte(invalid)); err == nil {
+			t.Errorf("expected error decoding %q", invalid)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package flywheel
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/aluttik/go-crossplane"
+)
+
+// headerMarker starts the comment SetHeader adds to each config
+const headerMarker = " nginx_flywheel: "
+
+// Versioned is an OverrideProvider whose values come from a versioned store
+type Versioned interface {
+	// Version describes the state of the store that was last rendered from, e.g. "etcd revision 42"
+	//
+	// An empty string means there's no version to record.
+	Version() string
+}
+
+// SetHeader makes a `# nginx_flywheel: <text>` comment the first line of every config
+//
+// A header from a previous render is replaced, so rendering a file in place doesn't stack headers.
+func SetHeader(p *crossplane.Payload, text string) {
+	comment := headerMarker + text
+	for i := range p.Config {
+		c := &p.Config[i]
+		parsed := c.Parsed
+		if len(parsed) != 0 && isHeader(parsed[0]) {
+			parsed = parsed[1:]
+		}
+		// crossplane.Build treats a comment on the previous line as trailing, so the header needs a line before 0
+		header := crossplane.Directive{Directive: "#", Line: -1, Args: []string{}, Comment: &comment}
+		c.Parsed = append([]crossplane.Directive{header}, parsed...)
+	}
+}
+
+func isHeader(d crossplane.Directive) bool {
+	return d.IsComment() && strings.HasPrefix(*d.Comment, headerMarker)
+}
+
+// stripHeader removes a leading header line from built NGINX config text
+func stripHeader(b []byte) []byte {
+	if !bytes.HasPrefix(b, []byte("#"+headerMarker)) {
+		return b
+	}
+	if i := bytes.IndexByte(b, '\n'); i >= 0 {
+		return b[i+1:]
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package flywheel
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aluttik/go-crossplane"
+)
+
+func TestSetHeader(t *testing.T) {
+	comment := " user comment"
+	payload := crossplane.Payload{Config: []crossplane.Config{{Parsed: []crossplane.Directive{
+		{Directive: "#", Line: 1, Args: []string{}, Comment: &comment},
+		{Directive: "worker_processes", Line: 2, Args: []string{"5"}},
+	}}}}
+	SetHeader(&payload, "rendered from etcd revision 1")
+	SetHeader(&payload, "rendered from etcd revision 2")
+
+	var rendered bytes.Buffer
+	if err := crossplane.Build(&rendered, payload.Config[0], &crossplane.BuildOptions{}); err != nil {
+		t.Fatalf("failed to build config: %v", err)
+	}
+	expected := "# nginx_flywheel: rendered from etcd revision 2\n# user comment\nworker_processes 5;"
+	if rendered.String() != expected {
+		t.Errorf("expected:\n%v\ngot:\n%v", expected, rendered.String())
+	}
+}
+
+func TestDiffPayloadIgnoresHeader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nginx-flywheel-test-")
+	if err != nil {
+		t.Fatalf("failed to create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	payload := crossplane.Payload{Config: []crossplane.Config{{File: filepath.Join(dir, "nginx.conf"), Parsed: []crossplane.Directive{
+		{Directive: "worker_processes", Line: 1, Args: []string{"5"}},
+	}}}}
+	SetHeader(&payload, "rendered from etcd revision 1")
+	if err = WritePayload(&payload, &crossplane.BuildOptions{}); err != nil {
+		t.Fatalf("failed to write payload: %v", err)
+	}
+
+	SetHeader(&payload, "rendered from etcd revision 2")
+	diffs, err := DiffPayload(&payload, &crossplane.BuildOptions{})
+	if err != nil {
+		t.Fatalf("failed to diff payload: %v", err)
+	}
+	if len(diffs) != 0 {
+		t.Errorf("expected a header change alone not to be a diff: %+v", diffs)
+	}
+
+	payload.Config[0].Parsed[1].Args = []string{"auto"}
+	diffs, err = DiffPayload(&payload, &crossplane.BuildOptions{})
+	if err != nil {
+		t.Fatalf("failed to diff payload: %v", err)
+	}
+	if len(diffs) != 1 || !strings.Contains(diffs[0].Diff, "+# nginx_flywheel: rendered from etcd revision 2") {
+		t.Errorf("expected the header in the diff of a changed file: %+v", diffs)
+	}
+}
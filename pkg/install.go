@@ -0,0 +1,308 @@
+package flywheel
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aluttik/go-crossplane"
+)
+
+// Installation is a payload that has been swapped into place and can still be rolled back
+//
+// The previous version of every replaced file is kept until Commit or Rollback.
+type Installation struct {
+	swapped []swappedFile
+}
+
+// swappedFile is an installed file and the backup of the file it replaced
+type swappedFile struct {
+	path string
+	// backup is empty when there was no file to replace
+	backup string
+}
+
+// InstallPayload writes every config of the payload, rolling back the files already replaced if one fails
+//
+// Every config is first staged and fsync'd next to its destination, so nothing is replaced until the whole payload
+// has been built. The staged files are then renamed over their destinations one by one, which replaces each file
+// atomically, and the directories are fsync'd. Symlinked destinations are resolved so the link target is replaced
+// rather than the link.
+//
+// The payload as a whole isn't swapped atomically: if the process dies part way through the swaps, some files are
+// new and some old, and the staged and backup files are left next to them. Those leftovers are removed by the next
+// install of the same files, which brings the tree back to a single version.
+//
+// The returned Installation must be committed, or rolled back if a later step such as validation or reload fails.
+func InstallPayload(p *crossplane.Payload, options *crossplane.BuildOptions) (*Installation, error) {
+	staged := make([]string, 0, len(p.Config))
+	targets := make([]string, 0, len(p.Config))
+	removeStaged := func() {
+		for _, s := range staged {
+			os.Remove(s)
+		}
+	}
+	for _, c := range p.Config {
+		target, err := resolveTarget(c.File)
+		if err != nil {
+			removeStaged()
+			return nil, err
+		}
+		if err = removeLeftovers(target); err != nil {
+			removeStaged()
+			return nil, err
+		}
+		s, err := stageConfig(target, c, options)
+		if err != nil {
+			removeStaged()
+			return nil, fmt.Errorf("failed to stage %v: %w", c.File, err)
+		}
+		staged = append(staged, s)
+		targets = append(targets, target)
+	}
+
+	return installStaged(staged, targets)
+}
+
+// installStaged swaps each staged file in over its target, or removes the target when its staged file is empty
+//
+// The staged files are removed and the swapped files rolled back when any of them fails.
+func installStaged(staged, targets []string) (*Installation, error) {
+	inst := &Installation{}
+	for i, target := range targets {
+		var err error
+		if staged[i] == "" {
+			err = inst.remove(target)
+		} else {
+			err = inst.swap(staged[i], target)
+		}
+		if err != nil {
+			for _, s := range staged {
+				if s != "" {
+					os.Remove(s)
+				}
+			}
+			err = fmt.Errorf("failed to install %v: %w", target, err)
+			if rbErr := inst.Rollback(); rbErr != nil {
+				return nil, fmt.Errorf("%v; %v", err, rbErr)
+			}
+			return nil, err
+		}
+	}
+	if err := syncDirs(targets); err != nil {
+		if rbErr := inst.Rollback(); rbErr != nil {
+			return nil, fmt.Errorf("%v; %v", err, rbErr)
+		}
+		return nil, err
+	}
+	return inst, nil
+}
+
+// resolveTarget follows a symlinked destination so the link itself is left in place
+func resolveTarget(path string) (string, error) {
+	target, err := filepath.EvalSymlinks(path)
+	if os.IsNotExist(err) {
+		return path, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %v: %w", path, err)
+	}
+	return target, nil
+}
+
+// leftoverPattern matches the staged and backup files an interrupted install leaves next to target
+func leftoverPattern(target string) string {
+	return filepath.Join(filepath.Dir(target), "."+filepath.Base(target)+".flywheel-*")
+}
+
+// removeLeftovers removes the staged and backup files an interrupted install left next to target
+func removeLeftovers(target string) error {
+	leftovers, err := filepath.Glob(leftoverPattern(target))
+	if err != nil {
+		return fmt.Errorf("failed to find leftover files of %v: %w", target, err)
+	}
+	for _, l := range leftovers {
+		if err = os.Remove(l); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove leftover file: %w", err)
+		}
+	}
+	return nil
+}
+
+// stageConfig builds the config into a staged file for target
+func stageConfig(target string, c crossplane.Config, options *crossplane.BuildOptions) (string, error) {
+	return stageFile(target, func(w io.Writer) error {
+		bw := bufio.NewWriter(w)
+		if err := crossplane.Build(bw, c, options); err != nil {
+			return fmt.Errorf("failed to write NGINX file: %w", err)
+		}
+		if err := bw.Flush(); err != nil {
+			return fmt.Errorf("failed to flush writer: %w", err)
+		}
+		return nil
+	})
+}
+
+// stageFile writes a hidden file in the directory of target with write
+//
+// Staging in the same directory keeps the later rename on one filesystem, which is what makes it atomic. The staged
+// file takes the mode of target when it exists.
+func stageFile(target string, write func(w io.Writer) error) (string, error) {
+	dir := filepath.Dir(target)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create NGINX config directory: %w", err)
+	}
+	var mode os.FileMode = 0644
+	if info, err := os.Stat(target); err == nil {
+		mode = info.Mode().Perm()
+	}
+	fd, err := ioutil.TempFile(dir, "."+filepath.Base(target)+".flywheel-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create staged file: %w", err)
+	}
+	staged := fd.Name()
+	fail := func(err error) (string, error) {
+		fd.Close()
+		os.Remove(staged)
+		return "", err
+	}
+	if err = write(fd); err != nil {
+		return fail(err)
+	}
+	if err = fd.Chmod(mode); err != nil {
+		return fail(fmt.Errorf("failed to set file mode: %w", err))
+	}
+	if err = fd.Sync(); err != nil {
+		return fail(fmt.Errorf("failed to sync write: %w", err))
+	}
+	if err = fd.Close(); err != nil {
+		os.Remove(staged)
+		return "", fmt.Errorf("failed to close staged file: %w", err)
+	}
+	return staged, nil
+}
+
+// swap renames staged over target, keeping a hard link to the file it replaces as the backup
+func (inst *Installation) swap(staged, target string) error {
+	backup := ""
+	if _, err := os.Lstat(target); err == nil {
+		backup = staged + ".orig"
+		if err = os.Link(target, backup); err != nil {
+			return fmt.Errorf("failed to back up current file: %w", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(staged, target); err != nil {
+		if backup != "" {
+			os.Remove(backup)
+		}
+		return err
+	}
+	inst.swapped = append(inst.swapped, swappedFile{path: target, backup: backup})
+	return nil
+}
+
+// remove moves target aside so Rollback can put it back
+func (inst *Installation) remove(target string) error {
+	if _, err := os.Lstat(target); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	fd, err := ioutil.TempFile(filepath.Dir(target), "."+filepath.Base(target)+".flywheel-removed-")
+	if err != nil {
+		return fmt.Errorf("failed to create backup file: %w", err)
+	}
+	fd.Close()
+	if err = os.Rename(target, fd.Name()); err != nil {
+		os.Remove(fd.Name())
+		return err
+	}
+	inst.swapped = append(inst.swapped, swappedFile{path: target, backup: fd.Name()})
+	return nil
+}
+
+// Files are the paths that were installed
+func (inst *Installation) Files() []string {
+	files := make([]string, len(inst.swapped))
+	for i, s := range inst.swapped {
+		files[i] = s.path
+	}
+	return files
+}
+
+// Rollback puts back the files the installation replaced and removes the files it created
+//
+// It's a no-op after Commit or a previous Rollback.
+func (inst *Installation) Rollback() error {
+	var errs []string
+	paths := make([]string, 0, len(inst.swapped))
+	for i := len(inst.swapped) - 1; i >= 0; i-- {
+		s := inst.swapped[i]
+		paths = append(paths, s.path)
+		var err error
+		if s.backup != "" {
+			err = os.Rename(s.backup, s.path)
+		} else {
+			err = os.Remove(s.path)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err.Error())
+		}
+	}
+	inst.swapped = nil
+	if err := syncDirs(paths); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf("failed to roll back: %v", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Commit keeps the installed files and removes the backups of the files they replaced
+//
+// It's a no-op after Rollback or a previous Commit.
+func (inst *Installation) Commit() error {
+	var errs []string
+	for _, s := range inst.swapped {
+		if s.backup == "" {
+			continue
+		}
+		if err := os.Remove(s.backup); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err.Error())
+		}
+	}
+	inst.swapped = nil
+	if len(errs) != 0 {
+		return fmt.Errorf("failed to remove backups: %v", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// syncDirs fsyncs the directory of each path so renames within them are durable
+func syncDirs(paths []string) error {
+	synced := make(map[string]bool)
+	for _, path := range paths {
+		dir := filepath.Dir(path)
+		if synced[dir] {
+			continue
+		}
+		synced[dir] = true
+		d, err := os.Open(dir)
+		if err != nil {
+			return fmt.Errorf("failed to open directory: %w", err)
+		}
+		err = d.Sync()
+		d.Close()
+		if err != nil {
+			return fmt.Errorf("failed to sync directory %v: %w", dir, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package flywheel
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/aluttik/go-crossplane"
+)
+
+func installTestPayload(dir string) *crossplane.Payload {
+	return &crossplane.Payload{Config: []crossplane.Config{
+		{File: filepath.Join(dir, "nginx.conf"), Parsed: []crossplane.Directive{{Directive: "worker_processes", Args: []string{"4"}}}},
+		{File: filepath.Join(dir, "conf.d", "proxy.conf"), Parsed: []crossplane.Directive{{Directive: "proxy_redirect", Args: []string{"off"}}}},
+	}}
+}
+
+// dirNames lists the names in dir
+func dirNames(t *testing.T, dir string) []string {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read %v: %v", dir, err)
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	return names
+}
+
+func TestInstallPayload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nginx-flywheel-test-")
+	if err != nil {
+		t.Fatalf("failed to create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	main := filepath.Join(dir, "nginx.conf")
+	if err = ioutil.WriteFile(main, []byte("worker_processes 1;\n"), 0640); err != nil {
+		t.Fatalf("failed to write current config: %v", err)
+	}
+
+	// left by an install that was interrupted part way
+	for _, leftover := range []string{".nginx.conf.flywheel-123", ".nginx.conf.flywheel-123.orig", ".nginx.conf.flywheel-removed-456"} {
+		if err = ioutil.WriteFile(filepath.Join(dir, leftover), nil, 0644); err != nil {
+			t.Fatalf("failed to write leftover file: %v", err)
+		}
+	}
+
+	inst, err := InstallPayload(installTestPayload(dir), &crossplane.BuildOptions{})
+	if err != nil {
+		t.Fatalf("failed to install payload: %v", err)
+	}
+	b, _ := ioutil.ReadFile(main)
+	if string(b) != "worker_processes 4;" {
+		t.Errorf("expected the new config to be installed got: %q", b)
+	}
+	if info, err := os.Stat(main); err != nil || info.Mode().Perm() != 0640 {
+		t.Errorf("expected the file mode to be kept: %v %v", info.Mode(), err)
+	}
+
+	if err = inst.Rollback(); err != nil {
+		t.Fatalf("failed to roll back: %v", err)
+	}
+	b, _ = ioutil.ReadFile(main)
+	if string(b) != "worker_processes 1;\n" {
+		t.Errorf("expected the previous config to be restored got: %q", b)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "conf.d", "proxy.conf")); !os.IsNotExist(err) {
+		t.Errorf("expected the new file to be removed: %v", err)
+	}
+	if names := dirNames(t, dir); !reflect.DeepEqual(names, []string{"conf.d", "nginx.conf"}) {
+		t.Errorf("expected staged files and backups to be removed: %v", names)
+	}
+}
+
+func TestInstallPayloadCommit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nginx-flywheel-test-")
+	if err != nil {
+		t.Fatalf("failed to create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err = ioutil.WriteFile(filepath.Join(dir, "nginx.conf"), []byte("worker_processes 1;\n"), 0644); err != nil {
+		t.Fatalf("failed to write current config: %v", err)
+	}
+
+	inst, err := InstallPayload(installTestPayload(dir), &crossplane.BuildOptions{})
+	if err != nil {
+		t.Fatalf("failed to install payload: %v", err)
+	}
+	if err = inst.Commit(); err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+	if names := dirNames(t, dir); !reflect.DeepEqual(names, []string{"conf.d", "nginx.conf"}) {
+		t.Errorf("expected backups to be removed: %v", names)
+	}
+	if err = inst.Rollback(); err != nil {
+		t.Fatalf("expected rollback after commit to be a no-op: %v", err)
+	}
+	b, _ := ioutil.ReadFile(filepath.Join(dir, "nginx.conf"))
+	if string(b) != "worker_processes 4;" {
+		t.Errorf("expected the committed config to stay got: %q", b)
+	}
+}
+
+func TestInstallPayloadFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nginx-flywheel-test-")
+	if err != nil {
+		t.Fatalf("failed to create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	main := filepath.Join(dir, "nginx.conf")
+	if err = ioutil.WriteFile(main, []byte("worker_processes 1;\n"), 0644); err != nil {
+		t.Fatalf("failed to write current config: %v", err)
+	}
+	// a non-empty directory in place of the second file can't be replaced
+	if err = os.MkdirAll(filepath.Join(dir, "conf.d", "proxy.conf", "keep"), 0755); err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+
+	if _, err = InstallPayload(installTestPayload(dir), &crossplane.BuildOptions{}); err == nil {
+		t.Fatalf("expected install to fail")
+	}
+	b, _ := ioutil.ReadFile(main)
+	if string(b) != "worker_processes 1;\n" {
+		t.Errorf("expected the first file to be rolled back got: %q", b)
+	}
+	if names := dirNames(t, filepath.Join(dir, "conf.d")); !reflect.DeepEqual(names, []string{"proxy.conf"}) {
+		t.Errorf("expected staged files to be removed: %v", names)
+	}
+}
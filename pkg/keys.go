@@ -0,0 +1,52 @@
+package flywheel
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// KeyScheme maps directives to hierarchical keys derived from their NGINX filepath
+//
+// It's shared by the key value providers so a key space can be moved between stores.
+type KeyScheme struct {
+	// LStrip is the prefix strip for NGINX config location
+	LStrip string
+}
+
+// Keys produces the keys that are looked up for a directive, most specific first
+//
+// A directive nested in blocks is first looked up by its block path, then by the file wide DirectiveKey. For
+// example proxy_pass in the domain1.com server of /etc/nginx/nginx.conf with LStrip /etc/nginx would look up
+// /nginx/http/server[domain1.com 443]/location[/]/proxy_pass and then /nginx/proxy_pass.
+func (k KeyScheme) Keys(ref DirectiveRef) []string {
+	if len(ref.Blocks) == 0 {
+		return []string{k.DirectiveKey(ref.Directive, ref.Path)}
+	}
+	return []string{k.DirectiveKey(ref.BlockPath(), ref.Path), k.DirectiveKey(ref.Directive, ref.Path)}
+}
+
+// BaseKey is the most specific key of a directive, which the bare names of its templates are relative to
+func (k KeyScheme) BaseKey(ref DirectiveRef) string {
+	return k.DirectiveKey(ref.BlockPath(), ref.Path)
+}
+
+// DirectiveKey produces a key from a directive and NGINX filepath
+//
+// For example directive listen with path /etc/nginx/nginx.conf and LStrip /etc/nginx would produce /nginx/listen
+func (k KeyScheme) DirectiveKey(directive, path string) string {
+	return strings.TrimPrefix(filepath.Clean(strings.TrimSuffix(path, filepath.Ext(path))), k.LStrip) + "/" + directive
+}
+
+// Prefixes produces the unique key prefixes that every directive key of the NGINX filepaths starts with
+func (k KeyScheme) Prefixes(paths []string) []string {
+	seen := make(map[string]bool, len(paths))
+	var prefixes []string
+	for _, path := range paths {
+		prefix := k.DirectiveKey("", path)
+		if !seen[prefix] {
+			seen[prefix] = true
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes
+}
@@ -0,0 +1,35 @@
+package flywheel
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestKeys(t *testing.T) {
+	k := KeyScheme{LStrip: "/etc/nginx"}
+
+	keys := k.Keys(DirectiveRef{Directive: "listen", Path: "/etc/nginx/nginx.conf"})
+	if !reflect.DeepEqual(keys, []string{"/nginx/listen"}) {
+		t.Errorf("unexpected top level keys: %v", keys)
+	}
+
+	keys = k.Keys(DirectiveRef{
+		Directive: "proxy_pass",
+		Path:      "/etc/nginx/nginx.conf",
+		Blocks:    []string{"http", "server[domain1.com 443]", "location[/]"},
+	})
+	expected := []string{"/nginx/http/server[domain1.com 443]/location[/]/proxy_pass", "/nginx/proxy_pass"}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected '%v' got '%v'", expected, keys)
+	}
+}
+
+func TestPrefixes(t *testing.T) {
+	k := KeyScheme{LStrip: "/etc/nginx"}
+
+	prefixes := k.Prefixes([]string{"/etc/nginx/nginx.conf", "/etc/nginx/conf/mime.types", "/etc/nginx/nginx.conf"})
+	expected := []string{"/nginx/", "/conf/mime/"}
+	if !reflect.DeepEqual(prefixes, expected) {
+		t.Errorf("expected '%v' got '%v'", expected, prefixes)
+	}
+}
@@ -0,0 +1,234 @@
+package flywheel
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/aluttik/go-crossplane"
+)
+
+// OpType is the kind of change an Operation makes to a directive
+type OpType string
+
+const (
+	// OpNone leaves the directive unchanged
+	OpNone OpType = ""
+	// OpReplace replaces the args of the directive
+	OpReplace OpType = "replace"
+	// OpDelete removes the directive, including its block
+	OpDelete OpType = "delete"
+	// OpInsert inserts new directives after the directive
+	OpInsert OpType = "insert"
+	// OpReplaceAll replaces the directive and every sibling with the same name, one directive per arg set
+	//
+	// The group is replaced where its first directive is. It manages repeated directives as a list, e.g. the
+	// `server` lines of an upstream.
+	OpReplaceAll OpType = "replace_all"
+)
+
+// Operation is a change an OverrideProvider makes to a directive
+//
+// The zero value leaves the directive unchanged.
+type Operation struct {
+	Op OpType `json:"op"`
+	// Args are the new args for OpReplace
+	Args []string `json:"args,omitempty"`
+	// Directives are inserted after the directive for OpInsert; they may contain blocks
+	Directives []crossplane.Directive `json:"directives,omitempty"`
+	// ArgSets are the args of each replacement directive for OpReplaceAll
+	ArgSets [][]string `json:"arg_sets,omitempty"`
+}
+
+// Replace is a convenience for an OpReplace Operation
+func Replace(args ...string) Operation {
+	if args == nil {
+		args = []string{}
+	}
+	return Operation{Op: OpReplace, Args: args}
+}
+
+// ReplaceAll is a convenience for an OpReplaceAll Operation
+func ReplaceAll(argSets ...[]string) Operation {
+	if argSets == nil {
+		argSets = [][]string{}
+	}
+	return Operation{Op: OpReplaceAll, ArgSets: argSets}
+}
+
+// Validate checks that the operation is well formed
+func (op Operation) Validate() error {
+	switch op.Op {
+	case OpNone, OpDelete:
+	case OpReplace:
+		if len(op.Directives) != 0 || len(op.ArgSets) != 0 {
+			return fmt.Errorf("%v operation can't have directives or arg sets", op.Op)
+		}
+	case OpReplaceAll:
+		if len(op.Directives) != 0 || len(op.Args) != 0 {
+			return fmt.Errorf("%v operation can't have directives or args", op.Op)
+		}
+	case OpInsert:
+		if len(op.Directives) == 0 {
+			return fmt.Errorf("%v operation requires directives", op.Op)
+		}
+		for _, d := range op.Directives {
+			if d.Directive == "" {
+				return fmt.Errorf("%v operation has a directive without a name", op.Op)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown operation: %q", op.Op)
+	}
+	return nil
+}
+
+// DecodeOperation decodes a stored value into an Operation
+//
+// A JSON object is decoded as an Operation, e.g. `{"op": "delete"}`, and a JSON array of strings replaces the args,
+// e.g. `["127.0.0.3:8000", "weight=5"]`. A JSON array of arrays of strings replaces all of the repeated directives,
+// e.g. `[["127.0.0.3:8000", "weight=5"], ["127.0.0.3:8001"]]`. Anything else is split into args with SplitArgs,
+// including a value that starts with `[` but isn't a JSON array, such as the IPv6 `[::]:443 ssl http2`.
+//
+// An empty or blank value is an error rather than a replace with no args, which NGINX would reject; `[]` replaces
+// the args with none explicitly.
+func DecodeOperation(value []byte) (Operation, error) {
+	trimmed := bytes.TrimSpace(value)
+	switch {
+	case len(trimmed) == 0:
+		return Operation{}, fmt.Errorf("empty value")
+	case bytes.HasPrefix(trimmed, []byte("{")):
+		var op Operation
+		if err := json.Unmarshal(trimmed, &op); err != nil {
+			return Operation{}, fmt.Errorf("malformed JSON operation %q: %w", trimmed, err)
+		}
+		if op.Op == OpReplace && op.Args == nil {
+			op.Args = []string{}
+		}
+		if op.Op == OpReplaceAll && op.ArgSets == nil {
+			op.ArgSets = [][]string{}
+		}
+		if err := op.Validate(); err != nil {
+			return Operation{}, err
+		}
+		return op, nil
+	case isJSONArray(trimmed):
+		var args []string
+		if err := json.Unmarshal(trimmed, &args); err == nil {
+			return Replace(args...), nil
+		}
+		var argSets [][]string
+		if err := json.Unmarshal(trimmed, &argSets); err != nil {
+			return Operation{}, fmt.Errorf("malformed JSON args %q, expected an array of strings or of arrays of strings: %w", trimmed, err)
+		}
+		return ReplaceAll(argSets...), nil
+	default:
+		args, err := SplitArgs(string(value))
+		if err != nil {
+			return Operation{}, err
+		}
+		return Replace(args...), nil
+	}
+}
+
+// isJSONArray reports whether a value starting with `[` is meant as a JSON array rather than args
+//
+// Valid JSON always is; otherwise it has to open with `["`, `[[` or `[]`, so a malformed array is reported instead of
+// being split into args.
+func isJSONArray(value []byte) bool {
+	if !bytes.HasPrefix(value, []byte("[")) {
+		return false
+	}
+	if json.Valid(value) {
+		return true
+	}
+	rest := bytes.TrimLeftFunc(value[1:], unicode.IsSpace)
+	return len(rest) != 0 && (rest[0] == '"' || rest[0] == '[' || rest[0] == ']')
+}
+
+// SplitArgs splits a string into args on whitespace, like a shell
+//
+// Single quotes keep everything up to the closing quote literally. Within double quotes, or outside of quotes, a
+// backslash escapes a quote, whitespace or another backslash; any other backslash is kept, so regular expressions
+// such as `\.php$` survive unquoted.
+func SplitArgs(s string) ([]string, error) {
+	args := []string{}
+	var arg strings.Builder
+	inArg := false
+	var quote rune
+	runes := []rune(s)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				arg.WriteRune(r)
+			}
+		case r == '\\' && i+1 < len(runes) && escapes(quote, runes[i+1]):
+			i++
+			arg.WriteRune(runes[i])
+			inArg = true
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else {
+				arg.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case unicode.IsSpace(r):
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote in %q", quote, s)
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+// escapes reports whether a backslash escapes the next rune, given the quote it's within
+func escapes(quote, next rune) bool {
+	if quote == '"' {
+		return next == '"' || next == '\\'
+	}
+	return next == '"' || next == '\'' || next == '\\' || unicode.IsSpace(next)
+}
+
+// EncodeArgs encodes args as a value that DecodeOperation replaces the args with
+//
+// A single arg that decodes back into itself is stored as is; anything else is stored as a JSON array.
+func EncodeArgs(args []string) ([]byte, error) {
+	if len(args) == 1 {
+		op, err := DecodeOperation([]byte(args[0]))
+		if err == nil && op.Op == OpReplace && len(op.Args) == 1 && op.Args[0] == args[0] {
+			return []byte(args[0]), nil
+		}
+	}
+	if args == nil {
+		args = []string{}
+	}
+	return json.Marshal(args)
+}
+
+// EncodeArgSets encodes the args of repeated directives as a value that DecodeOperation replaces them all with
+func EncodeArgSets(argSets [][]string) ([]byte, error) {
+	if argSets == nil {
+		argSets = [][]string{}
+	}
+	return json.Marshal(argSets)
+}
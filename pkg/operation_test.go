@@ -0,0 +1,124 @@
+package flywheel
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aluttik/go-crossplane"
+)
+
+func TestDecodeOperation(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected Operation
+		err      bool
+	}{
+		{value: "80", expected: Replace("80")},
+		{value: "127.0.0.3:8000 weight=5", expected: Replace("127.0.0.3:8000", "weight=5")},
+		{value: `main '$remote_addr - $remote_user' "\"$request\""`, expected: Replace("main", "$remote_addr - $remote_user", `"$request"`)},
+		{value: `~ \.php$`, expected: Replace("~", `\.php$`)},
+		{value: "", err: true},
+		{value: " \t\n", err: true},
+		{value: `["127.0.0.3:8000", "weight=5"]`, expected: Replace("127.0.0.3:8000", "weight=5")},
+		{value: ` ["a b"] `, expected: Replace("a b")},
+		{
+			value:    `[["127.0.0.3:8000", "weight=5"], ["127.0.0.3:8001"]]`,
+			expected: ReplaceAll([]string{"127.0.0.3:8000", "weight=5"}, []string{"127.0.0.3:8001"}),
+		},
+		{value: `[]`, expected: Replace()},
+		{value: `[::]:80`, expected: Replace("[::]:80")},
+		{value: `[::]:443 ssl http2`, expected: Replace("[::]:443", "ssl", "http2")},
+		{value: `[2001:db8::1]:8080 default_server`, expected: Replace("[2001:db8::1]:8080", "default_server")},
+		{value: `[ "80" ]`, expected: Replace("80")},
+		{value: `{"op": "replace_all", "arg_sets": [["a"]]}`, expected: ReplaceAll([]string{"a"})},
+		{value: `{"op": "replace_all"}`, expected: ReplaceAll()},
+		{value: `{"op": "replace_all", "args": ["a"]}`, err: true},
+		{value: `[["80"], "443"]`, err: true},
+		{value: `["80", 443]`, err: true},
+		{value: `["80"`, err: true},
+		{value: `[["80"]`, err: true},
+		{value: `[1]`, err: true},
+		{value: `"unterminated`, err: true},
+		{value: `{"op": "replace", "args": ["443", "ssl"]}`, expected: Replace("443", "ssl")},
+		{value: `{"op": "replace"}`, expected: Replace()},
+		{value: `{"op": "delete"}`, expected: Operation{Op: OpDelete}},
+		{
+			value:    `{"op": "insert", "directives": [{"directive": "gzip", "args": ["on"]}]}`,
+			expected: Operation{Op: OpInsert, Directives: []crossplane.Directive{{Directive: "gzip", Args: []string{"on"}}}},
+		},
+		{value: `{"op": "insert"}`, err: true},
+		{value: `{"op": "rename"}`, err: true},
+		{value: `{"op": `, err: true},
+	}
+	for _, test := range tests {
+		op, err := DecodeOperation([]byte(test.value))
+		if test.err {
+			if err == nil {
+				t.Errorf("expected error for %v", test.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %v: %v", test.value, err)
+			continue
+		}
+		if !reflect.DeepEqual(op, test.expected) {
+			t.Errorf("expected '%+v' got '%+v'", test.expected, op)
+		}
+	}
+}
+
+func TestEncodeArgs(t *testing.T) {
+	for _, args := range [][]string{{"80"}, {"127.0.0.3:8000", "weight=5"}, {"{"}, {"["}, {"[::]:80"}, {"a b"}, {`'`}, {""}, {}} {
+		value, err := EncodeArgs(args)
+		if err != nil {
+			t.Fatalf("failed to encode %v: %v", args, err)
+		}
+		op, err := DecodeOperation(value)
+		if err != nil {
+			t.Fatalf("failed to decode %s: %v", value, err)
+		}
+		if !reflect.DeepEqual(op, Replace(args...)) {
+			t.Errorf("expected '%+v' got '%+v'", Replace(args...), op)
+		}
+	}
+}
+
+func TestEncodeArgsPlain(t *testing.T) {
+	value, err := EncodeArgs([]string{"logs/error.log"})
+	if err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+	if string(value) != "logs/error.log" {
+		t.Errorf("expected a plain value got: %s", value)
+	}
+	value, err = EncodeArgs([]string{"[::]:80"})
+	if err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+	if string(value) != "[::]:80" {
+		t.Errorf("expected a plain value got: %s", value)
+	}
+	value, err = EncodeArgs([]string{"main", "$remote_addr - $remote_user"})
+	if err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+	if string(value) != `["main","$remote_addr - $remote_user"]` {
+		t.Errorf("expected a JSON array got: %s", value)
+	}
+}
+
+func TestEncodeArgSets(t *testing.T) {
+	argSets := [][]string{{"127.0.0.3:8000", "weight=5"}, {"192.168.0.1:8000"}}
+	value, err := EncodeArgSets(argSets)
+	if err != nil {
+		t.Fatalf("failed to encode %v: %v", argSets, err)
+	}
+	op, err := DecodeOperation(value)
+	if err != nil {
+		t.Fatalf("failed to decode %s: %v", value, err)
+	}
+	if !reflect.DeepEqual(op, ReplaceAll(argSets...)) {
+		t.Errorf("expected '%+v' got '%+v'", ReplaceAll(argSets...), op)
+	}
+}
@@ -0,0 +1,145 @@
+package flywheel
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/aluttik/go-crossplane"
+)
+
+// Reloader tells a running NGINX to load its config again
+//
+// Command takes precedence over PidFile when both are set.
+type Reloader struct {
+	// PidFile contains the pid of the NGINX master process, which is sent SIGHUP
+	PidFile string
+	// Command is run to reload NGINX, e.g. []string{"nginx", "-s", "reload"}
+	Command []string
+}
+
+// Reload signals the master process or runs the reload command
+//
+// Success means the reload was requested; NGINX logs and keeps its old config if the new one is rejected.
+func (r Reloader) Reload(ctx context.Context) error {
+	if len(r.Command) != 0 {
+		return r.runCommand(ctx)
+	}
+	if r.PidFile == "" {
+		return fmt.Errorf("no pid file or reload command configured")
+	}
+	pid, err := ReadPid(r.PidFile)
+	if err != nil {
+		return err
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return fmt.Errorf("failed to find NGINX master process %v: %w", pid, err)
+	}
+	// signal 0 checks the process exists without disturbing it
+	if err = p.Signal(syscall.Signal(0)); err != nil {
+		return fmt.Errorf("NGINX master process %v from %v isn't running: %w", pid, r.PidFile, err)
+	}
+	if err = p.Signal(syscall.SIGHUP); err != nil {
+		return fmt.Errorf("failed to signal NGINX master process %v: %w", pid, err)
+	}
+	return nil
+}
+
+func (r Reloader) runCommand(ctx context.Context) error {
+	cmd := exec.CommandContext(ctx, r.Command[0], r.Command[1:]...)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("reload command failed: %w: %v", err, strings.TrimSpace(output.String()))
+	}
+	return nil
+}
+
+// ReadPid reads a pid from an NGINX pid file
+func ReadPid(path string) (int, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read pid file: %w", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid pid in %v: %w", path, err)
+	}
+	return pid, nil
+}
+
+// DefaultNginxPrefix is the prefix of an NGINX built without configure's --prefix
+const DefaultNginxPrefix = "/usr/local/nginx/"
+
+// DefaultNginxPidPath is the pid file of an NGINX built without configure's --pid-path, relative to the prefix
+const DefaultNginxPidPath = "logs/nginx.pid"
+
+// NginxBuild is the compile time configuration that decides where an NGINX binary looks for its files
+type NginxBuild struct {
+	// Prefix is what relative paths in the config resolve against unless NGINX is run with -p
+	Prefix string
+	// PidPath is the pid file when the config has no pid directive; a relative path resolves against the prefix
+	PidPath string
+}
+
+// ReadNginxBuild reads the compile time configuration of the nginx binary from `nginx -V`
+func ReadNginxBuild(ctx context.Context, nginx string) (NginxBuild, error) {
+	output, err := exec.CommandContext(ctx, nginx, "-V").CombinedOutput()
+	if err != nil {
+		return NginxBuild{}, fmt.Errorf("failed to run %v -V: %w: %v", nginx, err, strings.TrimSpace(string(output)))
+	}
+	return ParseNginxBuild(string(output)), nil
+}
+
+// ParseNginxBuild parses the configure arguments printed by `nginx -V`, with NGINX's defaults for those not given
+func ParseNginxBuild(output string) NginxBuild {
+	b := NginxBuild{Prefix: DefaultNginxPrefix, PidPath: DefaultNginxPidPath}
+	for _, line := range strings.Split(output, "\n") {
+		const configure = "configure arguments:"
+		if !strings.HasPrefix(line, configure) {
+			continue
+		}
+		args, err := SplitArgs(strings.TrimPrefix(line, configure))
+		if err != nil {
+			args = strings.Fields(strings.TrimPrefix(line, configure))
+		}
+		for _, arg := range args {
+			switch {
+			case strings.HasPrefix(arg, "--prefix="):
+				b.Prefix = strings.TrimPrefix(arg, "--prefix=")
+			case strings.HasPrefix(arg, "--pid-path="):
+				b.PidPath = strings.TrimPrefix(arg, "--pid-path=")
+			}
+		}
+	}
+	return b
+}
+
+// PidFile finds the pid file set by the top level `pid` directive of the main config
+//
+// A relative path is resolved against prefix, which should match NGINX's `-p` prefix. False is returned when the
+// main config has no pid directive.
+func PidFile(p *crossplane.Payload, prefix string) (string, bool) {
+	if len(p.Config) == 0 {
+		return "", false
+	}
+	for _, d := range p.Config[0].Parsed {
+		if d.Directive == "pid" && len(d.Args) == 1 {
+			pid := d.Args[0]
+			if !filepath.IsAbs(pid) {
+				pid = filepath.Join(prefix, pid)
+			}
+			return pid, true
+		}
+	}
+	return "", false
+}
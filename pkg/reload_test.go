@@ -0,0 +1,95 @@
+package flywheel
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aluttik/go-crossplane"
+)
+
+func TestPidFile(t *testing.T) {
+	var payload crossplane.Payload
+	if err := json.Unmarshal([]byte(parsedExample), &payload); err != nil {
+		t.Fatalf("failed to unmarshal test data: %v", err)
+	}
+	pid, ok := PidFile(&payload, "/usr/local/nginx")
+	if !ok {
+		t.Fatalf("expected to find pid directive")
+	}
+	if pid != "/usr/local/nginx/logs/nginx.pid" {
+		t.Errorf("unexpected pid file: %v", pid)
+	}
+
+	payload.Config[0].Parsed[3].Args = []string{"/run/nginx.pid"}
+	if pid, _ = PidFile(&payload, "/usr/local/nginx"); pid != "/run/nginx.pid" {
+		t.Errorf("unexpected pid file: %v", pid)
+	}
+}
+
+func TestParseNginxBuild(t *testing.T) {
+	tests := []struct {
+		output   string
+		expected NginxBuild
+	}{
+		{
+			output: "nginx version: nginx/1.18.0 (Ubuntu)\nbuilt with OpenSSL 1.1.1f  31 Mar 2020\nTLS SNI support enabled\n" +
+				"configure arguments: --with-cc-opt='-g -O2 -fPIC' --prefix=/usr/share/nginx --conf-path=/etc/nginx/nginx.conf --pid-path=/run/nginx.pid\n",
+			expected: NginxBuild{Prefix: "/usr/share/nginx", PidPath: "/run/nginx.pid"},
+		},
+		{
+			output:   "nginx version: nginx/1.19.3\nconfigure arguments: --prefix=/opt/nginx\n",
+			expected: NginxBuild{Prefix: "/opt/nginx", PidPath: "logs/nginx.pid"},
+		},
+		{
+			output:   "nginx version: nginx/1.19.3\n",
+			expected: NginxBuild{Prefix: DefaultNginxPrefix, PidPath: "logs/nginx.pid"},
+		},
+	}
+	for _, test := range tests {
+		if b := ParseNginxBuild(test.output); b != test.expected {
+			t.Errorf("expected %+v got %+v", test.expected, b)
+		}
+	}
+}
+
+func TestReloadSignal(t *testing.T) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	dir, err := ioutil.TempDir("", "nginx-flywheel-test-")
+	if err != nil {
+		t.Fatalf("failed to create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	pidFile := filepath.Join(dir, "nginx.pid")
+	if err = ioutil.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		t.Fatalf("failed to write pid file: %v", err)
+	}
+
+	if err = (Reloader{PidFile: pidFile}).Reload(context.Background()); err != nil {
+		t.Fatalf("failed to reload: %v", err)
+	}
+	select {
+	case <-hup:
+	case <-time.After(5 * time.Second):
+		t.Errorf("expected SIGHUP")
+	}
+}
+
+func TestReloadCommand(t *testing.T) {
+	if err := (Reloader{Command: []string{"true"}}).Reload(context.Background()); err != nil {
+		t.Errorf("unexpected reload error: %v", err)
+	}
+	if err := (Reloader{Command: []string{"false"}}).Reload(context.Background()); err == nil {
+		t.Errorf("expected reload command to fail")
+	}
+}
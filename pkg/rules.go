@@ -0,0 +1,199 @@
+package flywheel
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/aluttik/go-crossplane"
+	"sigs.k8s.io/yaml"
+)
+
+// Rule applies an operation to every directive its selector matches
+//
+// Rules are read from a YAML or JSON list, with the fields of the Operation inline:
+//
+//   - select: http > server[server_name=domain1.com] > location[/] > proxy_pass
+//     op: replace
+//     args: ["http://127.0.0.1:9000"]
+//   - select: http > server sendfile
+//     op: delete
+//   - select: upstream[big_server_com] > server
+//     op: replace_all
+//     arg_sets: [["10.0.0.1:8000"], ["10.0.0.2:8000", "backup"]]
+type Rule struct {
+	Select string `json:"select"`
+	Operation
+
+	selector Selector
+}
+
+// ReadRules reads and decodes a rules file
+func ReadRules(path string) ([]Rule, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeRules(b)
+}
+
+// DecodeRules decodes a YAML or JSON list of rules, checking every selector and operation
+func DecodeRules(b []byte) ([]Rule, error) {
+	j, err := yaml.YAMLToJSON(b)
+	if err != nil {
+		return nil, fmt.Errorf("malformed rules: %w", err)
+	}
+	var rules []Rule
+	d := json.NewDecoder(bytes.NewReader(j))
+	d.DisallowUnknownFields()
+	if err = d.Decode(&rules); err != nil {
+		return nil, fmt.Errorf("malformed rules: %w", err)
+	}
+	for i := range rules {
+		r := &rules[i]
+		if r.selector, err = ParseSelector(r.Select); err != nil {
+			return nil, fmt.Errorf("rule %v: %w", i, err)
+		}
+		if r.Op == OpNone {
+			return nil, fmt.Errorf("rule %v for %q has no op", i, r.Select)
+		}
+		if r.Op == OpReplace && r.Args == nil {
+			r.Args = []string{}
+		}
+		if err = r.Validate(); err != nil {
+			return nil, fmt.Errorf("rule %v for %q: %w", i, r.Select, err)
+		}
+	}
+	return rules, nil
+}
+
+// ApplyRules applies each rule in turn to the payload and returns how many directives each rule matched
+//
+// Selectors see the payload as NGINX does: the directives of an included file are nested in the block of its
+// include directive, so `http > server` matches servers in an included conf.d file. A file is only visited once per
+// rule. Deleted directives and the replaced rest of an OpReplaceAll group aren't searched, and inserted directives
+// aren't matched by the rule that inserted them.
+func ApplyRules(p *crossplane.Payload, rules []Rule) ([]int, error) {
+	included := make(map[int]bool)
+	err := WalkPayload(p, func(_ DirectiveRef, d *crossplane.Directive) error {
+		if d.Includes != nil {
+			for _, i := range *d.Includes {
+				included[i] = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make([]int, len(rules))
+	for i, r := range rules {
+		a := &ruleApplier{p: p, rule: r, visited: make(map[int]bool)}
+		for j := range p.Config {
+			if j != 0 && included[j] {
+				continue
+			}
+			if err = a.applyConfig(j, nil); err != nil {
+				return nil, fmt.Errorf("rule %v for %q: %w", i, r.Select, err)
+			}
+		}
+		counts[i] = a.count
+	}
+	return counts, nil
+}
+
+// copyDirectives deep copies directives so every insert has its own blocks
+func copyDirectives(ds []crossplane.Directive) ([]crossplane.Directive, error) {
+	b, err := json.Marshal(ds)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal directives: %w", err)
+	}
+	var c []crossplane.Directive
+	if err = json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal directives: %w", err)
+	}
+	return c, nil
+}
+
+// ruleApplier is the state of applying one rule to a payload
+type ruleApplier struct {
+	p       *crossplane.Payload
+	rule    Rule
+	visited map[int]bool
+	count   int
+}
+
+// applyConfig applies the rule to a config of the payload, unless it's already been visited
+func (a *ruleApplier) applyConfig(i int, ancestors []crossplane.Directive) error {
+	if i < 0 || i >= len(a.p.Config) || a.visited[i] {
+		return nil
+	}
+	a.visited[i] = true
+	c := &a.p.Config[i]
+	return a.applyDirectives(&c.Parsed, c.File, ancestors)
+}
+
+// applyDirectives applies the rule to a list of directives and everything nested in them
+func (a *ruleApplier) applyDirectives(ds *[]crossplane.Directive, file string, ancestors []crossplane.Directive) error {
+	dsValues := *ds
+	applied := make([]crossplane.Directive, 0, len(dsValues))
+	// a selector can match several names, e.g. `upstream > *`, so each name is its own group
+	replacedGroups := make(map[string]bool)
+	for i := range dsValues {
+		d := &dsValues[i]
+		if d.IsComment() {
+			applied = append(applied, *d)
+			continue
+		}
+		matched := a.rule.selector.Match(ancestors, *d)
+		if matched {
+			a.count++
+			switch a.rule.Op {
+			case OpDelete:
+				continue
+			case OpReplace:
+				d.Args = a.rule.Args
+			case OpReplaceAll:
+				if d.IsBlock() {
+					return fmt.Errorf("%v:%v: %v can't replace block directives", file, d.Line, a.rule.Op)
+				}
+				if !replacedGroups[d.Directive] {
+					replacedGroups[d.Directive] = true
+					for _, args := range a.rule.ArgSets {
+						r := *d
+						r.Args = args
+						applied = append(applied, r)
+					}
+				}
+				continue
+			}
+		}
+
+		nested := append(ancestors[:len(ancestors):len(ancestors)], *d)
+		if d.Block != nil {
+			if err := a.applyDirectives(d.Block, file, nested); err != nil {
+				return err
+			}
+		}
+		if d.Includes != nil {
+			for _, included := range *d.Includes {
+				// included directives are nested where the include is, not in it
+				if err := a.applyConfig(included, ancestors); err != nil {
+					return err
+				}
+			}
+		}
+		applied = append(applied, *d)
+		if matched && a.rule.Op == OpInsert {
+			inserted, err := copyDirectives(a.rule.Directives)
+			if err != nil {
+				return err
+			}
+			applied = append(applied, inserted...)
+		}
+	}
+	*ds = applied
+	return nil
+}
@@ -0,0 +1,135 @@
+package flywheel
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aluttik/go-crossplane"
+)
+
+const rulesExample = `
+- select: http > server[server_name=domain1.com] > location[~ \.php$] > fastcgi_pass
+  op: replace
+  args: ["unix:/run/php.sock"]
+- select: upstream[big_server_com] > server
+  op: replace_all
+  arg_sets: [["10.0.0.1:8000"], ["10.0.0.2:8000", "backup"]]
+- select: http > server access_log
+  op: delete
+- select: http > server[big.server.com 80] > location[/]
+  op: insert
+  directives:
+    - directive: location
+      args: ["/api"]
+      block:
+        - directive: return
+          args: ["404"]
+- select: http > proxy_set_header
+  op: delete
+`
+
+func TestDecodeRules(t *testing.T) {
+	rules, err := DecodeRules([]byte(rulesExample))
+	if err != nil {
+		t.Fatalf("failed to decode rules: %v", err)
+	}
+	if len(rules) != 5 || rules[0].Op != OpReplace || !reflect.DeepEqual(rules[0].Args, []string{"unix:/run/php.sock"}) {
+		t.Errorf("unexpected rules: %+v", rules)
+	}
+
+	for _, bad := range []string{
+		`- select: "http >"` + "\n  op: delete",
+		`- select: http` + "\n  op: rename",
+		`- select: http`,
+		`- select: http` + "\n  op: delete\n  unknown: true",
+		`select: http`,
+	} {
+		if _, err = DecodeRules([]byte(bad)); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestApplyRules(t *testing.T) {
+	var payload crossplane.Payload
+	if err := json.Unmarshal([]byte(parsedExample), &payload); err != nil {
+		t.Fatalf("failed to unmarshal test data: %v", err)
+	}
+	rules, err := DecodeRules([]byte(rulesExample))
+	if err != nil {
+		t.Fatalf("failed to decode rules: %v", err)
+	}
+	counts, err := ApplyRules(&payload, rules)
+	if err != nil {
+		t.Fatalf("failed to apply rules: %v", err)
+	}
+	if !reflect.DeepEqual(counts, []int{1, 4, 3, 1, 3}) {
+		t.Errorf("unexpected match counts: %v", counts)
+	}
+
+	paths := make(map[string][][]string)
+	err = WalkPayload(&payload, func(ref DirectiveRef, d *crossplane.Directive) error {
+		paths[ref.BlockPath()] = append(paths[ref.BlockPath()], d.Args)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to walk payload: %v", err)
+	}
+	expected := map[string][][]string{
+		"http/server[domain1.com 80]/location[~ \\.php$]/fastcgi_pass": {{"unix:/run/php.sock"}},
+		"http/upstream[big_server_com]/server":                         {{"10.0.0.1:8000"}, {"10.0.0.2:8000", "backup"}},
+		"http/server[domain1.com 80]/access_log":                       nil,
+		"http/server[big.server.com 80]/location":                      {{"/"}, {"/api"}},
+		"http/server[big.server.com 80]/location[/api]/return":         {{"404"}},
+		// proxy.conf is included within http
+		"proxy_set_header": nil,
+		"proxy_redirect":   {{"off"}},
+	}
+	for path, args := range expected {
+		if !reflect.DeepEqual(paths[path], args) {
+			t.Errorf("%v: expected %v got %v", path, args, paths[path])
+		}
+	}
+}
+
+func TestApplyRulesReplaceAllBlock(t *testing.T) {
+	var payload crossplane.Payload
+	if err := json.Unmarshal([]byte(parsedExample), &payload); err != nil {
+		t.Fatalf("failed to unmarshal test data: %v", err)
+	}
+	rules, err := DecodeRules([]byte("- select: http > server\n  op: replace_all\n  arg_sets: [[]]"))
+	if err != nil {
+		t.Fatalf("failed to decode rules: %v", err)
+	}
+	if _, err = ApplyRules(&payload, rules); err == nil {
+		t.Errorf("expected replacing a group of blocks to fail")
+	}
+}
+
+func TestApplyRulesReplaceAllNames(t *testing.T) {
+	payload := crossplane.Payload{Config: []crossplane.Config{{File: "/etc/nginx/nginx.conf", Parsed: []crossplane.Directive{
+		{Directive: "upstream", Args: []string{"backend"}, Block: &[]crossplane.Directive{
+			{Directive: "server", Args: []string{"10.0.0.1:8000"}},
+			{Directive: "server", Args: []string{"10.0.0.2:8000"}},
+			{Directive: "keepalive", Args: []string{"16"}},
+			{Directive: "keepalive", Args: []string{"32"}},
+		}},
+	}}}}
+	rules, err := DecodeRules([]byte("- select: upstream > *\n  op: replace_all\n  arg_sets: [[\"1\"], [\"2\"]]"))
+	if err != nil {
+		t.Fatalf("failed to decode rules: %v", err)
+	}
+	if _, err = ApplyRules(&payload, rules); err != nil {
+		t.Fatalf("failed to apply rules: %v", err)
+	}
+	var got []string
+	for _, d := range *payload.Config[0].Parsed[0].Block {
+		got = append(got, d.Directive+" "+strings.Join(d.Args, " "))
+	}
+	expected := []string{"server 1", "server 2", "keepalive 1", "keepalive 2"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected each group to be replaced %v got %v", expected, got)
+	}
+}
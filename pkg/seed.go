@@ -0,0 +1,91 @@
+package flywheel
+
+import (
+	"sort"
+
+	"github.com/aluttik/go-crossplane"
+)
+
+// CurrentValues maps the most specific key of every directive without a block to its encoded args
+//
+// This is the reverse of OverridePayload; storing the values and rendering reproduces the payload. keys produces
+// the keys of a directive, most specific first, e.g. KeyScheme.Keys. Repeated directives within a block, such as the
+// server lines of an upstream, are stored together as arg sets that replace the whole group. A key shared by
+// directives in different blocks can't hold all of their args so it's left out and returned in duplicates.
+//
+// Annotations are honored the same as OverridePayload: a `flywheel:skip` directive and its block are left out, and a
+// directive with a `flywheel:key` is stored on its own under that key.
+func CurrentValues(p *crossplane.Payload, keys func(ref DirectiveRef) []string) (map[string][]byte, []string, error) {
+	values := make(map[string][]byte)
+	duplicated := make(map[string]bool)
+	for _, c := range p.Config {
+		if err := currentValues(c.Parsed, c.File, nil, 0, keys, values, duplicated); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var duplicates []string
+	for key := range duplicated {
+		duplicates = append(duplicates, key)
+		delete(values, key)
+	}
+	sort.Strings(duplicates)
+	return values, duplicates, nil
+}
+
+func currentValues(ds []crossplane.Directive, abspath string, blocks []string, parentLine int, keys func(ref DirectiveRef) []string, values map[string][]byte, duplicated map[string]bool) error {
+	// groups are keyed by directive name, or by custom key for an annotated directive
+	var groupKeys []string
+	groups := make(map[string][][]string)
+	custom := make(map[string]bool)
+	for i, d := range ds {
+		if d.IsComment() {
+			continue
+		}
+		a, err := directiveAnnotations(ds, i, parentLine)
+		if err != nil {
+			return newDirectiveError(&ds[i], abspath, blocks, err)
+		}
+		switch {
+		case a.skip:
+		case d.IsBlock():
+			err := currentValues(*d.Block, abspath, append(blocks[:len(blocks):len(blocks)], BlockName(d)), d.Line, keys, values, duplicated)
+			if err != nil {
+				return err
+			}
+		default:
+			group := d.Directive
+			if a.key != "" {
+				group = a.key
+				custom[group] = true
+			}
+			if _, ok := groups[group]; !ok {
+				groupKeys = append(groupKeys, group)
+			}
+			groups[group] = append(groups[group], d.Args)
+		}
+	}
+
+	for _, group := range groupKeys {
+		key := group
+		if !custom[group] {
+			key = keys(DirectiveRef{Directive: group, Path: abspath, Blocks: blocks})[0]
+		}
+		if _, ok := values[key]; ok {
+			duplicated[key] = true
+			continue
+		}
+		var value []byte
+		var err error
+		if argSets := groups[group]; len(argSets) == 1 {
+			value, err = EncodeArgs(argSets[0])
+		} else {
+			value, err = EncodeArgSets(argSets)
+		}
+		if err != nil {
+			return err
+		}
+		values[key] = value
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package flywheel
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/aluttik/go-crossplane"
+)
+
+func TestCurrentValues(t *testing.T) {
+	var payload crossplane.Payload
+	if err := json.Unmarshal([]byte(parsedExample), &payload); err != nil {
+		t.Fatalf("failed to unmarshal test data: %v", err)
+	}
+	keys := KeyScheme{LStrip: "../../test"}.Keys
+	values, duplicates, err := CurrentValues(&payload, keys)
+	if err != nil {
+		t.Fatalf("failed to produce current values: %v", err)
+	}
+
+	expected := map[string]string{
+		"/nginx/worker_processes": "5",
+		"/nginx/user":             `["www","www"]`,
+		"/nginx/http/server[domain2.com 80]/location[/]/proxy_pass": "http://127.0.0.1:8080",
+		"/proxy/proxy_redirect": "off",
+	}
+	for key, value := range expected {
+		if string(values[key]) != value {
+			t.Errorf("%v: expected '%v' got '%s'", key, value, values[key])
+		}
+	}
+	if _, ok := values["/nginx/http"]; ok {
+		t.Errorf("expected block directives to be left out")
+	}
+
+	// repeated directives are stored as a group
+	groups := map[string]string{
+		"/nginx/http/upstream[big_server_com]/server": `[["127.0.0.3:8000","weight=5"],["127.0.0.3:8001","weight=5"],["192.168.0.1:8000"],["192.168.0.1:8001"]]`,
+		"/proxy/proxy_set_header":                     `[["Host","$host"],["X-Real-IP","$remote_addr"],["X-Forwarded-For","$proxy_add_x_forwarded_for"]]`,
+	}
+	for key, value := range groups {
+		if string(values[key]) != value {
+			t.Errorf("%v: expected '%v' got '%s'", key, value, values[key])
+		}
+	}
+	if len(duplicates) != 0 {
+		t.Errorf("unexpected duplicates: %v", duplicates)
+	}
+
+	// storing the values and rendering reproduces the payload
+	for key, value := range values {
+		op, err := DecodeOperation(value)
+		if err != nil {
+			t.Fatalf("failed to decode %v: %v", key, err)
+		}
+		if key == "/nginx/user" && !reflect.DeepEqual(op, Replace("www", "www")) {
+			t.Errorf("unexpected round trip of %v: %+v", key, op)
+		}
+	}
+}
+
+func TestCurrentValuesDuplicates(t *testing.T) {
+	payload := crossplane.Payload{Config: []crossplane.Config{{File: "/etc/nginx/nginx.conf", Parsed: []crossplane.Directive{
+		{Directive: "location", Args: []string{"/"}, Block: &[]crossplane.Directive{{Directive: "root", Args: []string{"a"}}}},
+		{Directive: "location", Args: []string{"/"}, Block: &[]crossplane.Directive{{Directive: "root", Args: []string{"b"}}}},
+		{Directive: "index", Args: []string{"index.html"}},
+	}}}}
+	values, duplicates, err := CurrentValues(&payload, KeyScheme{LStrip: "/etc/nginx"}.Keys)
+	if err != nil {
+		t.Fatalf("failed to produce current values: %v", err)
+	}
+	if !reflect.DeepEqual(duplicates, []string{"/nginx/location[/]/root"}) {
+		t.Errorf("unexpected duplicates: %v", duplicates)
+	}
+	if _, ok := values["/nginx/location[/]/root"]; ok {
+		t.Errorf("expected duplicate to be left out of values")
+	}
+	if string(values["/nginx/index"]) != "index.html" {
+		t.Errorf("unexpected values: %v", values)
+	}
+}
+
+func TestCurrentValuesAnnotations(t *testing.T) {
+	payload := parseAnnotated(t, `worker_processes 5; # flywheel:skip
+# flywheel:key=/shared/error_log
+error_log logs/error.log;
+pid logs/nginx.pid;
+
+events { # flywheel:skip
+  worker_connections 1024;
+}
+`)
+	values, _, err := CurrentValues(payload, KeyScheme{LStrip: filepath.Dir(payload.Config[0].File)}.Keys)
+	if err != nil {
+		t.Fatalf("failed to produce current values: %v", err)
+	}
+	expected := map[string][]byte{
+		"/shared/error_log": []byte("logs/error.log"),
+		"/nginx/pid":        []byte("logs/nginx.pid"),
+	}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("expected %s got %s", expected, values)
+	}
+}
@@ -0,0 +1,188 @@
+package flywheel
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/aluttik/go-crossplane"
+)
+
+// Selector matches directives by where they are in the config, like a CSS selector
+//
+// A selector is a list of steps, outermost first. Steps separated by `>` must be directly nested and steps
+// separated by whitespace may be nested at any depth:
+//
+//	http > server[server_name=domain1.com] > location[/] > proxy_pass
+//	upstream[big_server_com] server
+//
+// A step is a directive name, or `*` for any directive, followed by any number of filters:
+//
+//	[args]       the args joined by spaces, or the block name the keys use, e.g. location[~ \.php$] or server[domain1.com 443]
+//	[name=value] the block has a name directive with value as one of its args, e.g. server[listen=443]
+//
+// A filter value may be double quoted, and `\]` escapes a closing bracket. A selector isn't anchored, so its first
+// step can match at any depth.
+type Selector struct {
+	text  string
+	steps []selectorStep
+}
+
+// selectorStep is one directive of a selector
+type selectorStep struct {
+	name string
+	// child is true when the step must be directly nested in the previous step
+	child   bool
+	filters []selectorFilter
+}
+
+// selectorFilter is a bracketed filter of a step
+type selectorFilter struct {
+	// directive is the child directive to look for, or empty to compare the args of the step
+	directive string
+	value     string
+}
+
+// childFilter matches the name=value form of a filter
+var childFilter = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*)=(.*)$`)
+
+// ParseSelector parses a selector such as `http > server[server_name=domain1.com] > listen`
+func ParseSelector(text string) (Selector, error) {
+	s := Selector{text: strings.TrimSpace(text)}
+	runes := []rune(s.text)
+	child := false
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '>':
+			if child || len(s.steps) == 0 {
+				return Selector{}, fmt.Errorf("unexpected > at %v in selector %q", i, text)
+			}
+			child = true
+			i++
+		default:
+			step := selectorStep{child: child}
+			start := i
+			for i < len(runes) && runes[i] != '[' && runes[i] != '>' && !unicode.IsSpace(runes[i]) {
+				i++
+			}
+			step.name = string(runes[start:i])
+			if step.name == "" {
+				return Selector{}, fmt.Errorf("missing directive name at %v in selector %q", start, text)
+			}
+			for i < len(runes) && runes[i] == '[' {
+				var content strings.Builder
+				i++
+				closed := false
+				for ; i < len(runes); i++ {
+					if runes[i] == '\\' && i+1 < len(runes) && runes[i+1] == ']' {
+						i++
+						content.WriteRune(']')
+						continue
+					}
+					if runes[i] == ']' {
+						closed = true
+						i++
+						break
+					}
+					content.WriteRune(runes[i])
+				}
+				if !closed {
+					return Selector{}, fmt.Errorf("unterminated [ in selector %q", text)
+				}
+				step.filters = append(step.filters, parseFilter(content.String()))
+			}
+			s.steps = append(s.steps, step)
+			child = false
+		}
+	}
+	if len(s.steps) == 0 {
+		return Selector{}, fmt.Errorf("empty selector")
+	}
+	if child {
+		return Selector{}, fmt.Errorf("selector %q ends with >", text)
+	}
+	return s, nil
+}
+
+// parseFilter parses the content of a bracketed filter
+func parseFilter(content string) selectorFilter {
+	if m := childFilter.FindStringSubmatch(content); m != nil {
+		return selectorFilter{directive: m[1], value: unquote(m[2])}
+	}
+	return selectorFilter{value: unquote(content)}
+}
+
+// unquote removes the double quotes around a filter value
+func unquote(value string) string {
+	if len(value) >= 2 && strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+func (s Selector) String() string {
+	return s.text
+}
+
+// Match reports whether the selector matches d, given the block directives enclosing it, outermost first
+func (s Selector) Match(ancestors []crossplane.Directive, d crossplane.Directive) bool {
+	last := len(s.steps) - 1
+	if !s.steps[last].match(d) {
+		return false
+	}
+	return s.matchAncestors(last-1, s.steps[last].child, ancestors)
+}
+
+// matchAncestors matches steps up to and including i against ancestors; child requires step i to be the innermost
+func (s Selector) matchAncestors(i int, child bool, ancestors []crossplane.Directive) bool {
+	if i < 0 {
+		return true
+	}
+	for j := len(ancestors) - 1; j >= 0; j-- {
+		if s.steps[i].match(ancestors[j]) && s.matchAncestors(i-1, s.steps[i].child, ancestors[:j]) {
+			return true
+		}
+		if child {
+			return false
+		}
+	}
+	return false
+}
+
+// match reports whether the step matches a single directive
+func (step selectorStep) match(d crossplane.Directive) bool {
+	if step.name != "*" && step.name != d.Directive {
+		return false
+	}
+	for _, f := range step.filters {
+		if !f.match(d) {
+			return false
+		}
+	}
+	return true
+}
+
+// match reports whether the filter matches a single directive
+func (f selectorFilter) match(d crossplane.Directive) bool {
+	if f.directive == "" {
+		return strings.Join(d.Args, " ") == f.value || BlockName(d) == d.Directive+"["+f.value+"]"
+	}
+	if d.Block == nil {
+		return false
+	}
+	for _, c := range *d.Block {
+		if c.Directive != f.directive {
+			continue
+		}
+		for _, arg := range c.Args {
+			if arg == f.value {
+				return true
+			}
+		}
+	}
+	return false
+}
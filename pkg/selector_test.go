@@ -0,0 +1,89 @@
+package flywheel
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/aluttik/go-crossplane"
+)
+
+func TestParseSelector(t *testing.T) {
+	for _, text := range []string{">", "http >", "http > > server", "location[/", "", "[/]"} {
+		if _, err := ParseSelector(text); err == nil {
+			t.Errorf("expected error for %q", text)
+		}
+	}
+	s, err := ParseSelector(`http>server[server_name="domain1.com"]  location[~ \.php$][fastcgi_pass=127.0.0.1:1025]`)
+	if err != nil {
+		t.Fatalf("failed to parse selector: %v", err)
+	}
+	expected := []selectorStep{
+		{name: "http"},
+		{name: "server", child: true, filters: []selectorFilter{{directive: "server_name", value: "domain1.com"}}},
+		{name: "location", filters: []selectorFilter{{value: `~ \.php$`}, {directive: "fastcgi_pass", value: "127.0.0.1:1025"}}},
+	}
+	if len(s.steps) != len(expected) {
+		t.Fatalf("expected %+v got %+v", expected, s.steps)
+	}
+	for i := range expected {
+		if s.steps[i].name != expected[i].name || s.steps[i].child != expected[i].child || len(s.steps[i].filters) != len(expected[i].filters) {
+			t.Errorf("step %v: expected %+v got %+v", i, expected[i], s.steps[i])
+			continue
+		}
+		for j, f := range expected[i].filters {
+			if s.steps[i].filters[j] != f {
+				t.Errorf("step %v: expected %+v got %+v", i, f, s.steps[i].filters[j])
+			}
+		}
+	}
+}
+
+func TestSelectorMatch(t *testing.T) {
+	var payload crossplane.Payload
+	if err := json.Unmarshal([]byte(parsedExample), &payload); err != nil {
+		t.Fatalf("failed to unmarshal test data: %v", err)
+	}
+	tests := map[string]int{
+		"http > server[server_name=domain1.com] > location[~ \\.php$] > fastcgi_pass": 1,
+		"http > server[domain2.com 80] > location[/] > proxy_pass":                    1,
+		"server location proxy_pass":                                                  2,
+		"http > proxy_pass":                                                           0,
+		"http proxy_pass":                                                             2,
+		"upstream[big_server_com] > server":                                           4,
+		"http > server":                                                               3,
+		"http > server[listen=80] > *":                                                14,
+		"events > worker_connections":                                                 1,
+		"http > worker_connections":                                                   0,
+		"server[server_name=www.domain2.com] access_log":                              1,
+	}
+	for text, expected := range tests {
+		s, err := ParseSelector(text)
+		if err != nil {
+			t.Fatalf("failed to parse %q: %v", text, err)
+		}
+		matched := 0
+		for _, c := range payload.Config {
+			matched += countMatches(s, c.Parsed, nil)
+		}
+		if matched != expected {
+			t.Errorf("%v: expected %v matches got %v", text, expected, matched)
+		}
+	}
+}
+
+// countMatches counts the directives s matches within ds, without following includes
+func countMatches(s Selector, ds []crossplane.Directive, ancestors []crossplane.Directive) int {
+	matched := 0
+	for _, d := range ds {
+		if d.IsComment() {
+			continue
+		}
+		if s.Match(ancestors, d) {
+			matched++
+		}
+		if d.Block != nil {
+			matched += countMatches(s, *d.Block, append(ancestors[:len(ancestors):len(ancestors)], d))
+		}
+	}
+	return matched
+}
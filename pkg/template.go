@@ -0,0 +1,259 @@
+package flywheel
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// KeyResolver is a provider that can resolve a key named in a template expression
+type KeyResolver interface {
+	// Resolve decodes the value of a flywheel key, e.g. /upstreams/api/port; false is returned when it doesn't exist
+	Resolve(ctx context.Context, key string) (Operation, bool, error)
+}
+
+// RelativeResolver is a KeyResolver that can resolve the bare names of a template, e.g. `{{host}}`
+type RelativeResolver interface {
+	KeyResolver
+	// BaseKey is the flywheel key that bare names in the args of a directive are relative to; empty when it has none
+	BaseKey(ref DirectiveRef) string
+}
+
+// templateKeyFuncs are the names of the function resolving a key
+//
+// Every name resolves through the configured provider; the provider names only let a config say where it expects
+// the value to come from.
+var templateKeyFuncs = []string{"key", "etcd", "consul", "env", "file"}
+
+// bareName matches an action that starts with a bare name, e.g. `{{host}}` or `{{ port | default "8080" }}`
+var bareName = regexp.MustCompile(`\{\{(-\s+|\s*)([A-Za-z_][A-Za-z0-9_-]*)(\s*(?:\||-?\}\}))`)
+
+// notBareNames are the identifiers that keep their template meaning at the start of an action
+var notBareNames = map[string]bool{
+	"default": true, "end": true, "else": true, "nil": true, "true": true, "false": true, "break": true,
+	"continue": true, "block": true, "define": true, "template": true, "if": true, "range": true, "with": true,
+}
+
+// expandBareNames rewrites each bare name of arg as a lookup of the key relative to base, e.g. `{{host}}` as
+// `{{key "<base>/host"}}`
+func expandBareNames(arg, base string) (string, error) {
+	var err error
+	expanded := bareName.ReplaceAllStringFunc(arg, func(action string) string {
+		m := bareName.FindStringSubmatch(action)
+		name := m[2]
+		if notBareNames[name] {
+			return action
+		}
+		if isKeyFunc(name) {
+			return action
+		}
+		if base == "" {
+			err = fmt.Errorf("bare name %q in template %q needs a provider that resolves keys relative to the directive", name, arg)
+			return action
+		}
+		return "{{" + m[1] + "key " + strconv.Quote(base+"/"+name) + m[3]
+	})
+	return expanded, err
+}
+
+// missingKey is the result of resolving a key that doesn't exist; it renders as nothing unless it's defaulted
+type missingKey string
+
+func (missingKey) String() string {
+	return ""
+}
+
+// hasTemplate reports whether any of args has a template expression for RenderArg
+func hasTemplate(args []string) bool {
+	for _, arg := range args {
+		if strings.Contains(arg, "{{") {
+			return true
+		}
+	}
+	return false
+}
+
+// RenderArgs renders the template expressions of each arg; see RenderArg
+func RenderArgs(ctx context.Context, args []string, r KeyResolver, base string) ([]string, error) {
+	var rendered []string
+	for i, arg := range args {
+		value, err := RenderArg(ctx, arg, r, base)
+		if err != nil {
+			return nil, err
+		}
+		if value != arg && rendered == nil {
+			rendered = make([]string, len(args))
+			copy(rendered, args[:i])
+		}
+		if rendered != nil {
+			rendered[i] = value
+		}
+	}
+	if rendered == nil {
+		return args, nil
+	}
+	return rendered, nil
+}
+
+// RenderArg resolves the template expressions within an arg
+//
+// Expressions use text/template syntax; `key` looks up a flywheel key through the provider and `default` replaces a
+// missing or empty value, so part of an arg can be dynamic:
+//
+//	http://{{ key "/upstreams/api/host" }}:{{ etcd "/upstreams/api/port" | default "8080" }}
+//
+// NGINX reads a brace as the start of a block, so an arg with an expression must be quoted in the config, e.g.
+// `proxy_pass 'http://{{ key "/upstreams/api/host" }}';`. etcd, consul, env and file are aliases of key. The value
+// of a key must replace args, which are joined by spaces. A key that's missing without a default is an error. Args
+// without `{{` are returned as is.
+//
+// A bare name is a key relative to base, the key of the directive from RelativeResolver.BaseKey. For example
+// `proxy_pass 'http://{{host}}:{{port}}';` in `location /` of the domain1.com server of /etc/nginx/nginx.conf, with
+// LStrip /etc/nginx, looks up /nginx/http/server[domain1.com 443]/location[/]/proxy_pass/host and .../proxy_pass/port. A
+// bare name can start a pipeline too, e.g. `{{ port | default "8080" }}`. It's an error when base is empty.
+func RenderArg(ctx context.Context, arg string, r KeyResolver, base string) (string, error) {
+	if !strings.Contains(arg, "{{") {
+		return arg, nil
+	}
+	text, err := expandBareNames(arg, base)
+	if err != nil {
+		return "", err
+	}
+	missing := make(map[string]int)
+	resolve := func(key string) (interface{}, error) {
+		op, ok, err := r.Resolve(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve %v: %w", key, err)
+		}
+		if !ok {
+			missing[key]++
+			return missingKey(key), nil
+		}
+		if op.Op != OpReplace {
+			return nil, fmt.Errorf("value of %v must replace args to be used in a template, got %q", key, op.Op)
+		}
+		return strings.Join(op.Args, " "), nil
+	}
+	funcs := template.FuncMap{
+		"default": func(def string, value interface{}) string {
+			if key, ok := value.(missingKey); ok {
+				if missing[string(key)]--; missing[string(key)] == 0 {
+					delete(missing, string(key))
+				}
+				return def
+			}
+			if s := fmt.Sprint(value); s != "" {
+				return s
+			}
+			return def
+		},
+	}
+	for _, name := range templateKeyFuncs {
+		funcs[name] = resolve
+	}
+
+	t, err := template.New("arg").Funcs(funcs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("malformed template %q: %w", arg, err)
+	}
+	var b strings.Builder
+	if err = t.Execute(&b, nil); err != nil {
+		return "", fmt.Errorf("failed to render template %q: %w", arg, err)
+	}
+	if len(missing) != 0 {
+		keys := make([]string, 0, len(missing))
+		for key := range missing {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		return "", fmt.Errorf("template %q uses missing keys without a default: %v", arg, strings.Join(keys, ", "))
+	}
+	return b.String(), nil
+}
+
+// TemplateKeys lists the keys the template expressions of args look up, in order, without resolving them
+//
+// base is the key bare names are relative to, as for RenderArg.
+func TemplateKeys(args []string, base string) ([]string, error) {
+	var keys []string
+	for _, arg := range args {
+		if !strings.Contains(arg, "{{") {
+			continue
+		}
+		text, err := expandBareNames(arg, base)
+		if err != nil {
+			return nil, err
+		}
+		funcs := template.FuncMap{"default": func(string, interface{}) string { return "" }}
+		for _, name := range templateKeyFuncs {
+			funcs[name] = func(string) string { return "" }
+		}
+		t, err := template.New("arg").Funcs(funcs).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("malformed template %q: %w", arg, err)
+		}
+		keys = appendTemplateKeys(keys, t.Tree.Root)
+	}
+	return keys, nil
+}
+
+// appendTemplateKeys appends the string keys passed to the key functions within node
+func appendTemplateKeys(keys []string, node parse.Node) []string {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return keys
+		}
+		for _, c := range n.Nodes {
+			keys = appendTemplateKeys(keys, c)
+		}
+	case *parse.ActionNode:
+		keys = appendTemplateKeys(keys, n.Pipe)
+	case *parse.IfNode:
+		keys = appendBranchKeys(keys, &n.BranchNode)
+	case *parse.RangeNode:
+		keys = appendBranchKeys(keys, &n.BranchNode)
+	case *parse.WithNode:
+		keys = appendBranchKeys(keys, &n.BranchNode)
+	case *parse.PipeNode:
+		if n == nil {
+			return keys
+		}
+		for _, c := range n.Cmds {
+			keys = appendTemplateKeys(keys, c)
+		}
+	case *parse.CommandNode:
+		if len(n.Args) == 2 {
+			ident, isIdent := n.Args[0].(*parse.IdentifierNode)
+			key, isString := n.Args[1].(*parse.StringNode)
+			if isIdent && isString && isKeyFunc(ident.Ident) {
+				return append(keys, key.Text)
+			}
+		}
+		for _, arg := range n.Args {
+			keys = appendTemplateKeys(keys, arg)
+		}
+	}
+	return keys
+}
+
+func appendBranchKeys(keys []string, n *parse.BranchNode) []string {
+	keys = appendTemplateKeys(keys, n.Pipe)
+	keys = appendTemplateKeys(keys, n.List)
+	return appendTemplateKeys(keys, n.ElseList)
+}
+
+// isKeyFunc reports whether name is one of templateKeyFuncs
+func isKeyFunc(name string) bool {
+	for _, f := range templateKeyFuncs {
+		if name == f {
+			return true
+		}
+	}
+	return false
+}
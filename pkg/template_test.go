@@ -0,0 +1,164 @@
+package flywheel
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/aluttik/go-crossplane"
+)
+
+// resolverProvider resolves keys from a map and overrides nothing
+type resolverProvider map[string]Operation
+
+func (r resolverProvider) Override(_ context.Context, _ DirectiveRef) (Operation, error) {
+	return Operation{}, nil
+}
+
+func (r resolverProvider) Resolve(_ context.Context, key string) (Operation, bool, error) {
+	if key == "/broken" {
+		return Operation{}, false, errors.New("unavailable")
+	}
+	op, ok := r[key]
+	return op, ok, nil
+}
+
+func (r resolverProvider) Close() error {
+	return nil
+}
+
+// relativeProvider is a resolverProvider that resolves bare names relative to the KeyScheme's keys
+type relativeProvider struct {
+	resolverProvider
+	KeyScheme
+}
+
+func TestRenderArg(t *testing.T) {
+	r := resolverProvider{
+		"/upstreams/api/host": Replace("10.0.0.1"),
+		"/upstreams/api/port": Replace("9000"),
+		"/empty":              Replace(),
+		"/deleted":            {Op: OpDelete},
+		"/base/host":          Replace("10.0.0.2"),
+	}
+	tests := []struct {
+		arg      string
+		base     string
+		expected string
+		err      bool
+	}{
+		{arg: "http://127.0.0.1:8080", expected: "http://127.0.0.1:8080"},
+		{arg: `http://{{ key "/upstreams/api/host" }}:{{ etcd "/upstreams/api/port" | default "8080" }}`, expected: "http://10.0.0.1:9000"},
+		{arg: `{{ consul "/upstreams/web/port" | default "8080" }}`, expected: "8080"},
+		{arg: `{{ env "/empty" | default "off" }}`, expected: "off"},
+		{arg: "{{ file `/upstreams/api/host` }}", expected: "10.0.0.1"},
+		{arg: `{{ key "/upstreams/web/port" }}`, err: true},
+		{arg: `{{ key "/upstreams/web/port" }}{{ key "/upstreams/web/port" | default "80" }}`, err: true},
+		{arg: `{{ key "/deleted" }}`, err: true},
+		{arg: `{{ key "/broken" | default "80" }}`, err: true},
+		{arg: `{{ unknown "/a" }}`, err: true},
+		{arg: `{{ key "/a"`, err: true},
+		{arg: `http://{{host}}`, err: true},
+		{arg: `http://{{host}}:{{ port | default "8080" }}`, base: "/base", expected: "http://10.0.0.2:8080"},
+		{arg: `{{- host -}}`, base: "/base", expected: "10.0.0.2"},
+		{arg: `{{ if key "/empty" }}on{{ else }}off{{ end }}`, base: "/base", expected: "off"},
+		{arg: `{{port}}`, base: "/base", err: true},
+	}
+	for _, test := range tests {
+		value, err := RenderArg(context.Background(), test.arg, r, test.base)
+		if test.err {
+			if err == nil {
+				t.Errorf("expected error for %v got %q", test.arg, value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %v: %v", test.arg, err)
+			continue
+		}
+		if value != test.expected {
+			t.Errorf("expected '%v' got '%v'", test.expected, value)
+		}
+	}
+}
+
+func TestOverridePayloadTemplates(t *testing.T) {
+	payload := crossplane.Payload{Config: []crossplane.Config{{File: "/etc/nginx/nginx.conf", Parsed: []crossplane.Directive{
+		{Directive: "location", Args: []string{"/"}, Block: &[]crossplane.Directive{
+			{Directive: "proxy_pass", Args: []string{`http://{{ key "/upstreams/api/host" }}:{{ key "/upstreams/api/port" | default "8080" }}`}},
+		}},
+	}}}}
+	r := resolverProvider{"/upstreams/api/host": Replace("10.0.0.1")}
+
+	original, err := CopyPayload(&payload)
+	if err != nil {
+		t.Fatalf("failed to copy payload: %v", err)
+	}
+	if err = OverridePayload(context.Background(), original, r, nil); err != nil {
+		t.Fatalf("failed to override payload: %v", err)
+	}
+	if !reflect.DeepEqual(original, &payload) {
+		t.Errorf("expected templates to be left alone unless enabled")
+	}
+
+	if err = OverridePayload(context.Background(), &payload, r, &OverrideOptions{Templates: true}); err != nil {
+		t.Fatalf("failed to override payload: %v", err)
+	}
+	proxyPass := (*payload.Config[0].Parsed[0].Block)[0]
+	if !reflect.DeepEqual(proxyPass.Args, []string{"http://10.0.0.1:8080"}) {
+		t.Errorf("unexpected args: %v", proxyPass.Args)
+	}
+
+	payload.Config[0].Parsed[0].Block = &[]crossplane.Directive{{Directive: "proxy_pass", Args: []string{"http://{{host}}:{{port}}"}}}
+	rel := relativeProvider{
+		resolverProvider: resolverProvider{"/nginx/location[/]/proxy_pass/host": Replace("10.0.0.3"), "/nginx/location[/]/proxy_pass/port": Replace("81")},
+		KeyScheme:        KeyScheme{LStrip: "/etc/nginx"},
+	}
+	if err = OverridePayload(context.Background(), &payload, rel, &OverrideOptions{Templates: true}); err != nil {
+		t.Fatalf("failed to override payload: %v", err)
+	}
+	proxyPass = (*payload.Config[0].Parsed[0].Block)[0]
+	if !reflect.DeepEqual(proxyPass.Args, []string{"http://10.0.0.3:81"}) {
+		t.Errorf("unexpected args from bare names: %v", proxyPass.Args)
+	}
+
+	err = OverridePayload(context.Background(), &payload, dummyProvider{}, &OverrideOptions{Templates: true})
+	if err == nil {
+		t.Errorf("expected a provider that can't resolve keys to fail")
+	}
+
+	// values from a provider aren't templates, even when they look like one
+	stored := `'{{ key "/secret" }}'`
+	o := &Chain{Providers: []OverrideProvider{
+		opProvider{"location[/]/proxy_pass": Replace(stored)},
+		resolverProvider{"/secret": Replace("leaked")},
+	}}
+	if err = OverridePayload(context.Background(), original, o, &OverrideOptions{Templates: true}); err != nil {
+		t.Fatalf("failed to override payload: %v", err)
+	}
+	proxyPass = (*original.Config[0].Parsed[0].Block)[0]
+	if !reflect.DeepEqual(proxyPass.Args, []string{stored}) {
+		t.Errorf("expected the stored value as is got: %v", proxyPass.Args)
+	}
+}
+
+func TestTemplateKeys(t *testing.T) {
+	args := []string{
+		"plain",
+		`http://{{ key "/a" }}:{{ etcd "/b" | default "80" }}`,
+		`{{host}}`,
+		`{{ if consul "/c" }}on{{ else }}{{ env "/d" }}{{ end }}`,
+	}
+	keys, err := TemplateKeys(args, "/base")
+	if err != nil {
+		t.Fatalf("failed to list template keys: %v", err)
+	}
+	expected := []string{"/a", "/b", "/base/host", "/c", "/d"}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected %v got %v", expected, keys)
+	}
+	if _, err = TemplateKeys([]string{`{{ key "/a"`}, ""); err == nil {
+		t.Errorf("expected a malformed template to fail")
+	}
+}
@@ -0,0 +1,120 @@
+package flywheel
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/aluttik/go-crossplane"
+)
+
+// DefaultValidateCommand tests an NGINX config without starting NGINX; the config path is appended
+var DefaultValidateCommand = []string{"nginx", "-t", "-c"}
+
+// Validator checks a rendered NGINX config before it's installed
+type Validator struct {
+	// Command is run with the path of the main config appended, e.g. DefaultValidateCommand
+	Command []string
+}
+
+// ValidationError is returned when the Validator command rejects a config
+type ValidationError struct {
+	// Output is the combined stdout and stderr of the command
+	Output string
+	Err    error
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("config failed validation: %v: %v", e.Err, strings.TrimSpace(e.Output))
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// Validate runs the command against the main config file
+func (v Validator) Validate(ctx context.Context, config string) error {
+	command := v.Command
+	if len(command) == 0 {
+		command = DefaultValidateCommand
+	}
+	cmd := exec.CommandContext(ctx, command[0], append(command[1:len(command):len(command)], config)...)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		return &ValidationError{Output: output.String(), Err: err}
+	}
+	return nil
+}
+
+// ValidatePayload validates a staged copy of the payload, so nothing has to be installed to find out it's rejected
+//
+// The payload is written to a temporary directory, mirroring the include tree like RelocatePayload, and the staged
+// main config, the first config of the payload, is validated. Every include that was followed when the payload was
+// parsed, relative or absolute, is rewritten in the staged copy to the staged files it included, so the rendered
+// tree is validated rather than the files currently installed. The staged files are removed afterwards.
+func ValidatePayload(ctx context.Context, p *crossplane.Payload, options *crossplane.BuildOptions, v Validator) error {
+	if len(p.Config) == 0 {
+		return fmt.Errorf("payload has no configs to validate")
+	}
+	staged, err := CopyPayload(p)
+	if err != nil {
+		return err
+	}
+	tmpDir, err := ioutil.TempDir("", "nginx-flywheel-")
+	if err != nil {
+		return fmt.Errorf("failed to create tmpdir: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	if err = RelocatePayload(staged, tmpDir); err != nil {
+		return err
+	}
+	for i := range staged.Config {
+		c := &staged.Config[i]
+		c.Parsed = stagedIncludes(c.Parsed, staged)
+		if err = writeConfig(c.File, *c, options); err != nil {
+			return fmt.Errorf("failed to stage %v: %w", p.Config[i].File, err)
+		}
+	}
+	return v.Validate(ctx, staged.Config[0].File)
+}
+
+// stagedIncludes replaces each followed include with an include of every staged file of p it included
+//
+// An include that matched no files is dropped, since it matched nothing when the payload was parsed either.
+func stagedIncludes(ds []crossplane.Directive, p *crossplane.Payload) []crossplane.Directive {
+	out := make([]crossplane.Directive, 0, len(ds))
+	for _, d := range ds {
+		if d.Block != nil {
+			block := stagedIncludes(*d.Block, p)
+			d.Block = &block
+		}
+		if !d.IsInclude() {
+			out = append(out, d)
+			continue
+		}
+		for _, i := range *d.Includes {
+			if i < 0 || i >= len(p.Config) {
+				continue
+			}
+			out = append(out, crossplane.Directive{Directive: d.Directive, Line: d.Line, Args: []string{p.Config[i].File}})
+		}
+	}
+	return out
+}
+
+// RemoveTmp removes the temporary directory created by WritePayloadTmp
+func RemoveTmp(files []UpdatedFile) error {
+	for _, f := range files {
+		if f.File != nil {
+			return os.RemoveAll(filepath.Dir(f.Name()))
+		}
+	}
+	return nil
+}
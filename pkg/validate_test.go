@@ -0,0 +1,93 @@
+package flywheel
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aluttik/go-crossplane"
+)
+
+func TestValidatorOutput(t *testing.T) {
+	v := Validator{Command: []string{"sh", "-c", "echo \"bad config: $1\" >&2; exit 1", "sh"}}
+	err := v.Validate(context.Background(), "nginx.conf")
+	var vErr *ValidationError
+	if !errors.As(err, &vErr) {
+		t.Fatalf("expected a ValidationError got: %v", err)
+	}
+	if strings.TrimSpace(vErr.Output) != "bad config: nginx.conf" {
+		t.Errorf("unexpected output: %q", vErr.Output)
+	}
+}
+
+func TestValidatePayload(t *testing.T) {
+	var payload crossplane.Payload
+	if err := json.Unmarshal([]byte(parsedExample), &payload); err != nil {
+		t.Fatalf("failed to unmarshal test data: %v", err)
+	}
+
+	err := ValidatePayload(context.Background(), &payload, &crossplane.BuildOptions{}, Validator{Command: []string{"false"}})
+	if err == nil {
+		t.Fatalf("expected validation to fail")
+	}
+	err = ValidatePayload(context.Background(), &payload, &crossplane.BuildOptions{}, Validator{Command: []string{"test", "-s"}})
+	if err != nil {
+		t.Fatalf("failed to validate payload: %v", err)
+	}
+}
+
+func TestValidatePayloadAbsoluteInclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nginx-flywheel-test-")
+	if err != nil {
+		t.Fatalf("failed to create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	confD := filepath.Join(dir, "conf.d")
+	if err = os.Mkdir(confD, 0755); err != nil {
+		t.Fatalf("failed to create conf.d: %v", err)
+	}
+	mainConfig := filepath.Join(dir, "nginx.conf")
+	files := map[string]string{
+		mainConfig:                          "events {}\nhttp {\n    include " + confD + "/*.conf;\n}\n",
+		filepath.Join(confD, "api.conf"):    "server {\n    listen 80;\n}\n",
+		filepath.Join(confD, "static.conf"): "server {\n    listen 8080;\n}\n",
+	}
+	for path, content := range files {
+		if err = ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write %v: %v", path, err)
+		}
+	}
+	payload, err := crossplane.Parse(mainConfig, &crossplane.ParseOptions{ParseComments: true})
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+
+	// rejects a config when any file it includes says bad, and when an include points outside of the staged tree
+	v := Validator{Command: []string{"sh", "-c", `
+dir=$(dirname "$1")
+for f in $(sed -n 's/^ *include \(.*\);$/\1/p' "$1"); do
+	case "$f" in "$dir"/*) ;; *) echo "include outside of staged tree: $f"; exit 1;; esac
+	if grep -q bad "$f"; then echo "bad value in $f"; exit 1; fi
+done`, "sh"}}
+	if err = ValidatePayload(context.Background(), payload, &crossplane.BuildOptions{}, v); err != nil {
+		t.Fatalf("failed to validate payload: %v", err)
+	}
+
+	(*payload.Config[2].Parsed[0].Block)[0].Args = []string{"bad"}
+	err = ValidatePayload(context.Background(), payload, &crossplane.BuildOptions{}, v)
+	var vErr *ValidationError
+	if !errors.As(err, &vErr) {
+		t.Fatalf("expected the rendered include to fail validation got: %v", err)
+	}
+	if !strings.Contains(vErr.Output, "static.conf") {
+		t.Errorf("unexpected output: %q", vErr.Output)
+	}
+	if content, _ := ioutil.ReadFile(filepath.Join(confD, "static.conf")); string(content) != files[filepath.Join(confD, "static.conf")] {
+		t.Errorf("expected the installed include to be left alone got: %q", content)
+	}
+}